@@ -1,16 +1,35 @@
 package ctx
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"time"
 )
 
+// RequestIDHeader carries the id of a request to the targets and back to
+// the client.
+const RequestIDHeader = "X-Request-Id"
+
+type contextKey struct{}
+
+// New creates the context for a request. The request is updated to carry
+// the context so it can be found again with From.
 func New(w http.ResponseWriter, r *http.Request) *Context {
-	return &Context{
+	c := &Context{
 		Writer: w,
-		Req:    r,
 		Quit:   make(chan struct{}),
 	}
+	c.Req = r.WithContext(context.WithValue(r.Context(), contextKey{}, c))
+	return c
+}
+
+// From returns the context of a request created with New.
+func From(r *http.Request) *Context {
+	c, _ := r.Context().Value(contextKey{}).(*Context)
+	return c
 }
 
 type Context struct {
@@ -18,10 +37,34 @@ type Context struct {
 	Writer   http.ResponseWriter
 	Req      *http.Request
 	Quit     chan struct{}
+	Retries  int
+
+	RequestID string
+
+	// Params are the path params captured by the route, like id for
+	// /users/:id.
+	Params map[string]string
+
+	// Handler and Target are the names of the handler and the last target
+	// the request was sent to, the upstream fields describe the responses
+	// from the targets.
+	Handler        string
+	Target         string
+	UpstreamStatus int
+	UpstreamTime   time.Duration
+}
+
+// Param returns a path param captured by the route or an empty string.
+func (ctx *Context) Param(name string) string {
+	return ctx.Params[name]
 }
 
 func (ctx *Context) ClientIp() string {
-	return ctx.Req.RemoteAddr
+	ip, _, err := net.SplitHostPort(ctx.Req.RemoteAddr)
+	if err != nil {
+		return ctx.Req.RemoteAddr
+	}
+	return ip
 }
 
 func (ctx *Context) Unauthorized() {
@@ -41,12 +84,19 @@ func (ctx *Context) NoneAvailable() {
 }
 
 func (ctx *Context) Finish() {
+	if ctx.Finished {
+		return
+	}
 	ctx.Finished = true
 	close(ctx.Quit)
 }
 
 func (ctx *Context) WithStatus(status int) {
 	result := fmt.Sprintf(`{"error": true, "code": %d, "message": "%s"}`, status, http.StatusText(status))
+	if ctx.RequestID != "" {
+		id, _ := json.Marshal(ctx.RequestID)
+		result = fmt.Sprintf(`{"error": true, "code": %d, "message": "%s", "request_id": %s}`, status, http.StatusText(status), id)
+	}
 	ctx.Writer.WriteHeader(status)
 	ctx.AsJson()
 	ctx.Write(result)
@@ -0,0 +1,353 @@
+package lb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coldog/proxy/lb/ctx"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+
+	commonTemplate   = `{remote_addr} - - [{time_local}] "{request}" {status} {bytes_out}`
+	combinedTemplate = commonTemplate + ` "{referer}" "{user_agent}"`
+)
+
+var defaultLogFields = []string{
+	"time", "request_id", "remote_addr", "method", "host", "path", "proto",
+	"status", "bytes_in", "bytes_out", "handler", "target", "upstream_status",
+	"upstream_latency_ms", "latency_ms", "retries", "user_agent",
+}
+
+var logField = regexp.MustCompile(`\{(\w+)\}`)
+
+// AccessLogConfig configures the access log. Format is json, common,
+// combined or a template where {field} is replaced with the value of a
+// field, for example "{method} {path} {status} {latency_ms}".
+type AccessLogConfig struct {
+	// Path is the file to write to, empty or "-" for stdout.
+	Path   string
+	Format string
+
+	// Fields selects the fields written by the json format.
+	Fields []string
+
+	// MaxSize in bytes after which the file is rotated to Path.1, up to
+	// MaxBackups old files are kept. Zero disables rotation.
+	MaxSize    int64
+	MaxBackups int
+}
+
+func (c *AccessLogConfig) Validate() error {
+	errs := ValidationErrors{}
+
+	fields := c.Fields
+	switch c.Format {
+	case "", FormatJSON, FormatCommon, FormatCombined:
+	default:
+		fields = nil
+		for _, m := range logField.FindAllStringSubmatch(c.Format, -1) {
+			fields = append(fields, m[1])
+		}
+		if len(fields) == 0 {
+			errs.Add("format", "must be json, common, combined or a template with {fields}")
+		}
+	}
+
+	for _, f := range fields {
+		if _, ok := logFields[f]; !ok {
+			errs.Add("fields", "unknown field "+f)
+		}
+	}
+
+	if c.MaxSize < 0 {
+		errs.Add("max_size", "must not be negative")
+	}
+	if c.MaxBackups < 0 {
+		errs.Add("max_backups", "must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// accessEntry holds what is known about a request once it is done.
+type accessEntry struct {
+	start time.Time
+	total time.Duration
+	r     *http.Request
+	c     *ctx.Context
+	w     *responseRecorder
+	in    *countingReader
+}
+
+var logFields = map[string]func(e *accessEntry) interface{}{
+	"time":       func(e *accessEntry) interface{} { return e.start.UTC().Format(time.RFC3339Nano) },
+	"time_local": func(e *accessEntry) interface{} { return e.start.Format("02/Jan/2006:15:04:05 -0700") },
+	"request_id": func(e *accessEntry) interface{} { return e.c.RequestID },
+	"remote_addr": func(e *accessEntry) interface{} {
+		host, _, err := net.SplitHostPort(e.r.RemoteAddr)
+		if err != nil {
+			return e.r.RemoteAddr
+		}
+		return host
+	},
+	"method":     func(e *accessEntry) interface{} { return e.r.Method },
+	"host":       func(e *accessEntry) interface{} { return e.r.Host },
+	"path":       func(e *accessEntry) interface{} { return e.r.URL.RequestURI() },
+	"proto":      func(e *accessEntry) interface{} { return e.r.Proto },
+	"request":    func(e *accessEntry) interface{} { return e.r.Method + " " + e.r.URL.RequestURI() + " " + e.r.Proto },
+	"status":     func(e *accessEntry) interface{} { return e.w.status() },
+	"bytes_in":   func(e *accessEntry) interface{} { return e.in.n },
+	"bytes_out":  func(e *accessEntry) interface{} { return e.w.bytes },
+	"referer":    func(e *accessEntry) interface{} { return e.r.Referer() },
+	"user_agent": func(e *accessEntry) interface{} { return e.r.UserAgent() },
+	"handler":    func(e *accessEntry) interface{} { return e.c.Handler },
+	"target":     func(e *accessEntry) interface{} { return e.c.Target },
+	"upstream_status": func(e *accessEntry) interface{} {
+		return e.c.UpstreamStatus
+	},
+	"upstream_latency_ms": func(e *accessEntry) interface{} {
+		return millis(e.c.UpstreamTime)
+	},
+	"latency_ms": func(e *accessEntry) interface{} { return millis(e.total) },
+	"retries":    func(e *accessEntry) interface{} { return e.c.Retries },
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d/time.Microsecond) / 1000
+}
+
+// accessLogger formats entries and writes them to the log one line at a
+// time.
+type accessLogger struct {
+	json     bool
+	fields   []string
+	template string
+	lock     sync.Mutex
+	out      io.WriteCloser
+}
+
+func newAccessLogger(c *AccessLogConfig) (*accessLogger, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &accessLogger{fields: c.Fields}
+	switch c.Format {
+	case "", FormatJSON:
+		l.json = true
+		if len(l.fields) == 0 {
+			l.fields = defaultLogFields
+		}
+	case FormatCommon:
+		l.template = commonTemplate
+	case FormatCombined:
+		l.template = combinedTemplate
+	default:
+		l.template = c.Format
+	}
+
+	if c.Path == "" || c.Path == "-" {
+		l.out = nopCloser{os.Stdout}
+		return l, nil
+	}
+
+	l.out, err = newRotatingFile(c.Path, c.MaxSize, c.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *accessLogger) format(e *accessEntry) []byte {
+	buf := bytes.Buffer{}
+
+	if l.json {
+		buf.WriteByte('{')
+		for i, f := range l.fields {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			k, _ := json.Marshal(f)
+			v, _ := json.Marshal(logFields[f](e))
+			buf.Write(k)
+			buf.WriteByte(':')
+			buf.Write(v)
+		}
+		buf.WriteString("}\n")
+		return buf.Bytes()
+	}
+
+	buf.WriteString(logField.ReplaceAllStringFunc(l.template, func(m string) string {
+		v := logFields[m[1:len(m)-1]](e)
+		if v, ok := v.(string); ok {
+			if v == "" {
+				return "-"
+			}
+			q := strconv.Quote(v)
+			return q[1 : len(q)-1]
+		}
+		return fmt.Sprint(v)
+	}))
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func (l *accessLogger) log(e *accessEntry) {
+	line := l.format(e)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(line)
+}
+
+func (l *accessLogger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.out.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// responseRecorder records the status and size of the response while
+// passing hijacking and flushing through to the underlying writer.
+type responseRecorder struct {
+	http.ResponseWriter
+	code     int
+	bytes    int64
+	hijacked bool
+}
+
+func (w *responseRecorder) status() int {
+	if w.hijacked {
+		return http.StatusSwitchingProtocols
+	}
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+func (w *responseRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *responseRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijacking not supported")
+	}
+	w.hijacked = true
+	return hj.Hijack()
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// rotatingFile is an append only file that is rotated once it grows past
+// its maximum size.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	size       int64
+	f          *os.File
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves path.n to path.n+1, dropping the oldest backup, and starts
+// a new file.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+
+	if r.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,159 @@
+package lb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/coldog/proxy/lb/router"
+)
+
+func accessLogServer(t *testing.T, c *AccessLogConfig, backend string) *Server {
+	config := DefaultConfig()
+	config.AccessLog = c
+	config.TrustRequestID = true
+	s := New(config)
+	if s.accessLog == nil {
+		t.Fatal("access log not enabled")
+	}
+	s.PutHandler(&Handler{
+		Name:        "api",
+		Routes:      []*router.Route{{Path: "/api/*"}},
+		Targets:     []*Target{{ID: "t1", URL: backend, Weight: 1}},
+		RetryPolicy: &RetryPolicy{MaxAttempts: 2, RetryNonIdempotent: true, MaxBodyBytes: 1024},
+	})
+	return s
+}
+
+func TestAccessLog_JSON(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	dir, _ := ioutil.TempDir("", "access")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	s := accessLogServer(t, &AccessLogConfig{Path: path}, ts.URL)
+
+	req := httptest.NewRequest("PUT", "/api/x?y=1", strings.NewReader("body"))
+	req.Header.Set("X-Request-Id", "abc")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+	s.accessLog.Close()
+
+	data, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", data)
+	}
+
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]interface{}{
+		"request_id":      "abc",
+		"method":          "PUT",
+		"path":            "/api/x?y=1",
+		"status":          float64(200),
+		"bytes_in":        float64(4),
+		"bytes_out":       float64(5),
+		"handler":         "api",
+		"target":          "t1",
+		"upstream_status": float64(200),
+		"retries":         float64(1),
+	} {
+		if entry[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, entry[k])
+		}
+	}
+	if entry["latency_ms"].(float64) < entry["upstream_latency_ms"].(float64) {
+		t.Errorf("total latency below upstream latency %v", entry)
+	}
+
+	if !strings.Contains(lines[1], `"status":503`) || !strings.Contains(lines[1], `"handler":""`) {
+		t.Errorf("unexpected unmatched entry %s", lines[1])
+	}
+}
+
+func TestAccessLog_Formats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	}))
+	defer ts.Close()
+
+	for format, want := range map[string]string{
+		FormatCommon:                            `192.0.2.1 - - [`,
+		FormatCombined:                          `"GET /api/x HTTP/1.1" 200 2 "-" "test \"agent\""`,
+		"{handler} {target} {status} {retries}": "api t1 200 0\n",
+	} {
+		dir, _ := ioutil.TempDir("", "access")
+		path := filepath.Join(dir, "access.log")
+
+		s := accessLogServer(t, &AccessLogConfig{Path: path, Format: format}, ts.URL)
+		req := httptest.NewRequest("GET", "/api/x", nil)
+		req.Header.Set("User-Agent", `test "agent"`)
+		s.ServeHTTP(httptest.NewRecorder(), req)
+		s.accessLog.Close()
+
+		data, _ := ioutil.ReadFile(path)
+		if !strings.Contains(string(data), want) {
+			t.Errorf("%s: expected %q in %q", format, want, data)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAccessLog_Rotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "access")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	f, err := newRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		f.Write([]byte(line))
+	}
+	f.Close()
+
+	for name, want := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		data, _ := ioutil.ReadFile(name)
+		if string(data) != want {
+			t.Errorf("%s: expected %q, got %q", name, want, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected old backups to be removed")
+	}
+}
+
+func TestAccessLog_Validate(t *testing.T) {
+	err := (&AccessLogConfig{Format: "{nope} {status}"}).Validate()
+	if err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Fatalf("expected unknown field error, got %v", err)
+	}
+	if (&AccessLogConfig{Format: "no fields"}).Validate() == nil {
+		t.Fatal("expected a template without fields to fail")
+	}
+}
@@ -0,0 +1,109 @@
+package lb
+
+import (
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// ACMEConfig enables automatic certificates for the hosts of the routes of
+// all handlers. Challenges are answered over http-01 by the server itself.
+type ACMEConfig struct {
+	DirectoryURL string        `json:"directory_url"`
+	DirectoryCA  string        `json:"directory_ca"`
+	Email        string        `json:"email"`
+	CacheDir     string        `json:"cache_dir"`
+	Hosts        []string      `json:"hosts"`
+	RenewBefore  time.Duration `json:"renew_before"`
+	Interval     time.Duration `json:"interval"`
+}
+
+func newACMEManager(s *Server, c *ACMEConfig) (*autocert.Manager, error) {
+	if c.CacheDir == "" {
+		return nil, errors.New("acme: cache_dir is required")
+	}
+
+	client := &acme.Client{DirectoryURL: c.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+
+	if c.DirectoryCA != "" {
+		data, err := ioutil.ReadFile(c.DirectoryCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("acme: no certificates in " + c.DirectoryCA)
+		}
+
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(c.CacheDir),
+		Email:       c.Email,
+		RenewBefore: c.RenewBefore,
+		Client:      client,
+		HostPolicy:  s.acmeHostPolicy,
+	}, nil
+}
+
+// acmeHosts returns the hosts to get certificates for, which are the
+// configured hosts and the literal hosts of all routes.
+func (s *Server) acmeHosts() []string {
+	return append(append([]string(nil), s.config.ACME.Hosts...), s.router.Hosts()...)
+}
+
+func (s *Server) acmeHostPolicy(ctx context.Context, host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, h := range s.acmeHosts() {
+		if strings.EqualFold(h, host) {
+			return nil
+		}
+	}
+	return errors.New("acme: host not configured " + host)
+}
+
+// obtainCerts requests certificates for all hosts ahead of the first
+// handshake. Certificates that are already cached are only renewed once
+// they are about to expire.
+func (s *Server) obtainCerts(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, host := range s.acmeHosts() {
+			_, err := s.acme.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+			if err != nil {
+				log.Printf("[ERROR] acme: certificate for %s failed %v", host, err)
+			}
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package lb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coldog/proxy/lb/router"
+)
+
+// testACME is a minimal ACME server that issues certificates from a local
+// CA after validating http-01 challenges against the load balancer.
+type testACME struct {
+	t      *testing.T
+	url    string
+	lb     http.Handler
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	lock   sync.Mutex
+	thumb  string
+	orders []*testOrder
+}
+
+type testOrder struct {
+	host   string
+	token  string
+	status string
+	cert   []byte
+}
+
+func newTestACME(t *testing.T, lb http.Handler) (*testACME, *httptest.Server) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	a := &testACME{t: t, lb: lb, ca: ca, caKey: key}
+	srv := httptest.NewServer(a)
+	a.url = srv.URL
+	return a, srv
+}
+
+func (a *testACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	w.Header().Set("Replay-Nonce", fmt.Sprint(time.Now().UnixNano()))
+
+	if r.URL.Path == "/dir" {
+		a.json(w, 200, map[string]string{
+			"newNonce":   a.url + "/nonce",
+			"newAccount": a.url + "/account",
+			"newOrder":   a.url + "/order",
+			"revokeCert": a.url + "/revoke",
+			"keyChange":  a.url + "/key",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(200)
+		return
+	}
+
+	var jws struct{ Protected, Payload string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var o *testOrder
+	id := 0
+	if len(parts) == 2 {
+		fmt.Sscan(parts[1], &id)
+		o = a.orders[id]
+	}
+
+	switch parts[0] {
+	case "account":
+		var header struct{ JWK map[string]string }
+		json.Unmarshal(protected, &header)
+		k := header.JWK
+		sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, k["crv"], k["kty"], k["x"], k["y"])))
+		a.thumb = base64.RawURLEncoding.EncodeToString(sum[:])
+
+		w.Header().Set("Location", a.url+"/acct/1")
+		a.json(w, 201, map[string]string{"status": "valid"})
+
+	case "order":
+		var req struct{ Identifiers []struct{ Value string } }
+		json.Unmarshal(payload, &req)
+		o = &testOrder{host: req.Identifiers[0].Value, token: fmt.Sprintf("token%d", len(a.orders)), status: "pending"}
+		a.orders = append(a.orders, o)
+		a.order(w, 201, len(a.orders)-1, o)
+
+	case "orders":
+		a.order(w, 200, id, o)
+
+	case "authz":
+		a.json(w, 200, map[string]interface{}{
+			"status":     authzStatus(o),
+			"identifier": map[string]string{"type": "dns", "value": o.host},
+			"challenges": []map[string]string{a.challenge(id, o)},
+		})
+
+	case "chal":
+		req := httptest.NewRequest("GET", "http://"+o.host+acmeChallengePath+o.token, nil)
+		rec := httptest.NewRecorder()
+		a.lb.ServeHTTP(rec, req)
+		if rec.Body.String() == o.token+"."+a.thumb {
+			o.status = "ready"
+		} else {
+			a.t.Logf("challenge failed: %d %s", rec.Code, rec.Body.String())
+			o.status = "invalid"
+		}
+		a.json(w, 200, a.challenge(id, o))
+
+	case "finalize":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			a.json(w, 400, map[string]string{"type": "urn:ietf:params:acme:error:badCSR"})
+			return
+		}
+
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(id + 2)),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		cert, err := x509.CreateCertificate(rand.Reader, tmpl, a.ca, csr.PublicKey, a.caKey)
+		if err != nil {
+			a.t.Fatal(err)
+		}
+
+		o.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.ca.Raw})...)
+		o.status = "valid"
+		a.order(w, 200, id, o)
+
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(o.cert)
+
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func authzStatus(o *testOrder) string {
+	if o.status == "pending" || o.status == "invalid" {
+		return o.status
+	}
+	return "valid"
+}
+
+func (a *testACME) challenge(id int, o *testOrder) map[string]string {
+	return map[string]string{
+		"type":   "http-01",
+		"url":    fmt.Sprintf("%s/chal/%d", a.url, id),
+		"token":  o.token,
+		"status": authzStatus(o),
+	}
+}
+
+func (a *testACME) order(w http.ResponseWriter, status, id int, o *testOrder) {
+	body := map[string]interface{}{
+		"status":         o.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.host}},
+		"authorizations": []string{fmt.Sprintf("%s/authz/%d", a.url, id)},
+		"finalize":       fmt.Sprintf("%s/finalize/%d", a.url, id),
+	}
+	if o.cert != nil {
+		body["certificate"] = fmt.Sprintf("%s/cert/%d", a.url, id)
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/orders/%d", a.url, id))
+	a.json(w, status, body)
+}
+
+func (a *testACME) json(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestACME_Obtain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := DefaultConfig()
+	cfg.ACME = &ACMEConfig{CacheDir: dir}
+	s := New(cfg)
+
+	ca, srv := newTestACME(t, s)
+	defer srv.Close()
+	s.acme.Client.DirectoryURL = ca.url + "/dir"
+
+	s.PutHandler(&Handler{
+		Name:   "acme",
+		Routes: []*router.Route{{Host: "a.example.com"}, {Host: "api.stuff.*"}},
+	})
+
+	cert, err := s.Certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || leaf.DNSNames[0] != "a.example.com" || leaf.Issuer.CommonName != "test ca" {
+		t.Fatalf("unexpected certificate %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "a.example.com+rsa")); err != nil {
+		t.Fatal("certificate not persisted")
+	}
+
+	if _, err := s.Certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"}); err == nil {
+		t.Fatal("issued a certificate for an unknown host")
+	}
+}
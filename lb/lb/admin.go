@@ -0,0 +1,353 @@
+package lb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Admin returns the http handler for the admin api. It exposes the
+// following resources:
+//
+//	GET                /handlers
+//	GET, PUT, DELETE   /handlers/{name}
+//	GET                /handlers/{name}/targets
+//	GET, PUT, DELETE   /handlers/{name}/targets/{id}
+//	GET                /metrics
+//
+// Every response carries an ETag with the version of the handler, writes
+// may send an If-Match header to only apply if the handler is unchanged.
+func (s *Server) Admin() http.Handler {
+	return http.HandlerFunc(s.serveAdmin)
+}
+
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if len(parts) == 1 && parts[0] == "metrics" {
+		s.serveMetrics(w, r)
+		return
+	}
+
+	if parts[0] != "handlers" || len(parts) > 4 {
+		adminError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+
+	switch len(parts) {
+	case 1:
+		if r.Method != "GET" {
+			adminError(w, http.StatusMethodNotAllowed, nil)
+			return
+		}
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		adminJson(w, http.StatusOK, s.handlerMap())
+
+	case 2:
+		switch r.Method {
+		case "GET":
+			s.getHandler(w, r, parts[1])
+		case "PUT":
+			s.adminPutHandler(w, r, parts[1])
+		case "DELETE":
+			s.adminRemoveHandler(w, r, parts[1])
+		default:
+			adminError(w, http.StatusMethodNotAllowed, nil)
+		}
+
+	case 3:
+		if parts[2] != "targets" {
+			adminError(w, http.StatusNotFound, ErrNotFound)
+			return
+		}
+		if r.Method != "GET" {
+			adminError(w, http.StatusMethodNotAllowed, nil)
+			return
+		}
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		h, ok := s.handlerMap()[parts[1]]
+		if !ok {
+			adminError(w, http.StatusNotFound, ErrNotFound)
+			return
+		}
+		setETag(w, h.version)
+		adminJson(w, http.StatusOK, h.targets())
+
+	case 4:
+		if parts[2] != "targets" {
+			adminError(w, http.StatusNotFound, ErrNotFound)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			s.getTarget(w, r, parts[1], parts[3])
+		case "PUT":
+			s.adminPutTarget(w, r, parts[1], parts[3])
+		case "DELETE":
+			s.adminRemoveTarget(w, r, parts[1], parts[3])
+		default:
+			adminError(w, http.StatusMethodNotAllowed, nil)
+		}
+	}
+}
+
+func (s *Server) getHandler(w http.ResponseWriter, r *http.Request, name string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	h, ok := s.handlerMap()[name]
+	if !ok {
+		adminError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+
+	setETag(w, h.version)
+	adminJson(w, http.StatusOK, h)
+}
+
+func (s *Server) adminPutHandler(w http.ResponseWriter, r *http.Request, name string) {
+	h := &Handler{}
+	err := adminDecode(r, h)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if h.Name == "" {
+		h.Name = name
+	} else if h.Name != name {
+		adminError(w, http.StatusBadRequest, ValidationErrors{{Field: "name", Message: "does not match path"}})
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current, exists := s.handlerMap()[name]
+	if !checkVersion(r, current) {
+		adminError(w, http.StatusPreconditionFailed, ErrVersionMismatch)
+		return
+	}
+
+	// the sticky secret is never served, an update without it keeps the
+	// current one.
+	if h.StickySession != nil && h.StickySession.Secret == "" && exists && current.StickySession != nil {
+		h.StickySession.Secret = current.StickySession.Secret
+	}
+
+	err = h.Validate()
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.putHandler(h)
+
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+
+	setETag(w, h.version)
+	adminJson(w, status, h)
+}
+
+func (s *Server) adminRemoveHandler(w http.ResponseWriter, r *http.Request, name string) {
+	s.lock.Lock()
+	h, ok := s.handlerMap()[name]
+	if !ok {
+		s.lock.Unlock()
+		adminError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+	if !checkVersion(r, h) {
+		s.lock.Unlock()
+		adminError(w, http.StatusPreconditionFailed, ErrVersionMismatch)
+		return
+	}
+	h.setDraining()
+	s.lock.Unlock()
+
+	s.drain(name, h)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getTarget(w http.ResponseWriter, r *http.Request, name, id string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	h, ok := s.handlerMap()[name]
+	if !ok {
+		adminError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+
+	t := h.Target(id)
+	if t == nil {
+		adminError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+
+	setETag(w, h.version)
+	adminJson(w, http.StatusOK, t)
+}
+
+func (s *Server) adminPutTarget(w http.ResponseWriter, r *http.Request, name, id string) {
+	t := &Target{}
+	err := adminDecode(r, t)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if t.ID == "" {
+		t.ID = id
+	} else if t.ID != id {
+		adminError(w, http.StatusBadRequest, ValidationErrors{{Field: "id", Message: "does not match path"}})
+		return
+	}
+
+	err = t.Validate()
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	h, ok := s.handlerMap()[name]
+	if !ok {
+		adminError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+	if !checkVersion(r, h) {
+		adminError(w, http.StatusPreconditionFailed, ErrVersionMismatch)
+		return
+	}
+
+	status := http.StatusOK
+	if h.Target(id) == nil {
+		status = http.StatusCreated
+	}
+
+	s.putTarget(h, t)
+
+	setETag(w, h.version)
+	adminJson(w, status, t)
+}
+
+func (s *Server) adminRemoveTarget(w http.ResponseWriter, r *http.Request, name, id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	h, ok := s.handlerMap()[name]
+	if !ok {
+		adminError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+	if !checkVersion(r, h) {
+		adminError(w, http.StatusPreconditionFailed, ErrVersionMismatch)
+		return
+	}
+
+	if !s.removeTarget(h, id) {
+		adminError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+
+	setETag(w, h.version)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkVersion validates the If-Match and If-None-Match headers against
+// the current handler, which is nil if it does not exist yet.
+func checkVersion(r *http.Request, h *Handler) bool {
+	if match := r.Header.Get("If-None-Match"); match == "*" && h != nil {
+		return false
+	}
+
+	match := r.Header.Get("If-Match")
+	if match == "" {
+		return true
+	}
+	if h == nil {
+		return false
+	}
+	if match == "*" {
+		return true
+	}
+
+	for _, tag := range strings.Split(match, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag(h.version) {
+			return true
+		}
+	}
+	return false
+}
+
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+func setETag(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", etag(version))
+}
+
+// adminDecode decodes a json body, durations may be written as strings
+// like in the config file.
+func adminDecode(r *http.Request, v interface{}) error {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	data, err = parseDurations(data, v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func adminJson(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[ERROR] failed to print json %v", err)
+		status = http.StatusInternalServerError
+		data = []byte(fmt.Sprintf(`{"error": true, "code": %d, "message": "%s"}`, status, http.StatusText(status)))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+type adminErrorBody struct {
+	Error   bool             `json:"error"`
+	Code    int              `json:"code"`
+	Message string           `json:"message"`
+	Errors  ValidationErrors `json:"errors,omitempty"`
+}
+
+func adminError(w http.ResponseWriter, status int, err error) {
+	body := adminErrorBody{
+		Error:   true,
+		Code:    status,
+		Message: http.StatusText(status),
+	}
+
+	if verr, ok := err.(ValidationErrors); ok {
+		body.Errors = verr
+	} else if err != nil {
+		body.Message = err.Error()
+	}
+
+	adminJson(w, status, body)
+}
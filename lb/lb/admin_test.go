@@ -0,0 +1,69 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminReq(s *Server, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.Admin().ServeHTTP(w, req)
+	return w
+}
+
+func TestAdmin_PutHandler(t *testing.T) {
+	s := New(DefaultConfig())
+
+	w := adminReq(s, "PUT", "/handlers/test", `{"strategy": "rr", "routes": [{"path": "/test"}], "targets": [{"id": "t1", "url": "http://localhost:3000"}]}`, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if !s.HasHandler("test") {
+		t.Fatal("handler was not added")
+	}
+
+	tag := w.Header().Get("ETag")
+	if tag == "" {
+		t.Fatal("missing etag")
+	}
+
+	w = adminReq(s, "PUT", "/handlers/test/targets/t2", `{"url": "http://localhost:3001"}`, map[string]string{"If-Match": tag})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = adminReq(s, "DELETE", "/handlers/test/targets/t1", "", map[string]string{"If-Match": tag})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412, got %d", w.Code)
+	}
+
+	w = adminReq(s, "GET", "/handlers/test/targets", "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"t2"`) {
+		t.Fatalf("unexpected targets %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdmin_Validation(t *testing.T) {
+	s := New(DefaultConfig())
+
+	w := adminReq(s, "PUT", "/handlers/test", `{"strategy": "nope", "targets": [{"id": "t1", "url": "localhost"}]}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	if !strings.Contains(body, `"field":"strategy"`) || !strings.Contains(body, `"field":"targets[0].url"`) {
+		t.Fatalf("unexpected errors: %s", body)
+	}
+
+	w = adminReq(s, "DELETE", "/handlers/missing", "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
@@ -1,51 +1,71 @@
 package lb
 
 import (
-	"net/http"
+	"flag"
 	"fmt"
+	"net/http"
 	"testing"
 	"time"
+
 	"github.com/coldog/proxy/lb/stats"
 )
 
+var loadTest = flag.Bool("load", false, "run the load test against a load balancer on localhost:9888")
+
 var s stats.StatsCollector = stats.New(stats.MEMORY)
 
-func listen(p int) {
-	http.ListenAndServe(fmt.Sprintf(":%d", p), func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Hello!"))
-		w.WriteHeader(200)
-	})
+func listen(p int) *http.Server {
+	srv := &http.Server{
+		Addr: fmt.Sprintf(":%d", p),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello!"))
+		}),
+	}
+	go srv.ListenAndServe()
+	return srv
 }
 
-func load(path string, n int, t time.Duration)  {
+func load(path string, n int, t time.Duration) {
 	start := time.Now()
 
+	done := make(chan struct{})
 	for i := 0; i < n; i++ {
 		go func() {
+			defer func() { done <- struct{}{} }()
 			for {
 				httpClient := &http.Client{}
 				resp, err := httpClient.Get("http://localhost:9888" + path)
 
 				if err != nil {
-					return err
+					return
 				}
+				resp.Body.Close()
 
 				s.SetIncrement(statusCodeName(resp), 1)
 
-				if start.Add(t).After(time.Now()) {
+				if time.Now().After(start.Add(t)) {
 					return
 				}
 			}
 		}()
 	}
+
+	for i := 0; i < n; i++ {
+		<-done
+	}
 }
 
+// TestLoad sends requests to a load balancer started separately with the
+// targets on ports 3000 to 3004, it only runs with -load.
 func TestLoad(t *testing.T) {
+	if !*loadTest {
+		t.Skip("load test, run with -load")
+	}
 
 	for i := 0; i < 5; i++ {
-		listen(3000 + i)
+		srv := listen(3000 + i)
+		defer srv.Close()
 	}
 
-	load("/test", 20, 30 * time.Second)
-
-}
\ No newline at end of file
+	load("/test", 20, 30*time.Second)
+}
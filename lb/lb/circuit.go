@@ -0,0 +1,300 @@
+package lb
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coldog/proxy/lb/ctx"
+	"github.com/coldog/proxy/lb/stats"
+)
+
+const (
+	ReasonHeader      = "X-Lb-Reason"
+	ReasonCircuitOpen = "circuit_open"
+	ReasonMaxRequests = "max_requests"
+	ReasonMaxPending  = "max_pending"
+	ReasonMaxRetries  = "max_retries"
+)
+
+// CircuitBreaker configures the breakers of the targets of a handler and
+// the limits of the handler itself. Targets trip open after the failure
+// threshold of consecutive failures and are not sent any requests until the
+// open timeout passed, after which a limited number of probes is allowed
+// through. A zero value disables the corresponding breaker or limit.
+type CircuitBreaker struct {
+	FailureThreshold int           `json:"failure_threshold"`
+	SuccessThreshold int           `json:"success_threshold"`
+	OpenTimeout      time.Duration `json:"open_timeout"`
+	HalfOpenRequests int           `json:"half_open_requests"`
+	MaxRequests      int           `json:"max_requests"`
+	MaxPending       int           `json:"max_pending"`
+	PendingTimeout   time.Duration `json:"pending_timeout"`
+	MaxRetries       int           `json:"max_retries"`
+}
+
+func (cb *CircuitBreaker) setDefaults() {
+	if cb.SuccessThreshold <= 0 {
+		cb.SuccessThreshold = 1
+	}
+	if cb.OpenTimeout <= 0 {
+		cb.OpenTimeout = 30 * time.Second
+	}
+	if cb.HalfOpenRequests <= 0 {
+		cb.HalfOpenRequests = 1
+	}
+	if cb.PendingTimeout <= 0 {
+		cb.PendingTimeout = time.Second
+	}
+}
+
+func (cb *CircuitBreaker) Validate() error {
+	errs := ValidationErrors{}
+
+	if cb.FailureThreshold < 0 {
+		errs.Add("failure_threshold", "must not be negative")
+	}
+	if cb.MaxRequests < 0 {
+		errs.Add("max_requests", "must not be negative")
+	}
+	if cb.MaxPending < 0 {
+		errs.Add("max_pending", "must not be negative")
+	}
+	if cb.MaxPending > 0 && cb.MaxRequests == 0 {
+		errs.Add("max_pending", "requires max_requests")
+	}
+	if cb.MaxRetries < 0 {
+		errs.Add("max_retries", "must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type breaker struct {
+	lock      sync.Mutex
+	state     int
+	failures  int
+	successes int
+	openUntil time.Time
+	probes    int
+}
+
+func (b *breaker) open(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state == breakerOpen && now.Before(b.openUntil)
+}
+
+// allow checks whether a request may be sent, moving an open breaker to
+// half open once the open timeout passed. It returns nil if the request is
+// refused, otherwise a func that must be called once the request is done
+// to give back the probe of a half open breaker.
+func (b *breaker) allow(cb *CircuitBreaker, now time.Time) (done func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return nil
+		}
+		b.state = breakerHalfOpen
+		b.successes = 0
+		b.probes = 0
+		fallthrough
+	case breakerHalfOpen:
+		if b.probes >= cb.HalfOpenRequests {
+			return nil
+		}
+		b.probes++
+		return b.release
+	}
+	return func() {}
+}
+
+func (b *breaker) release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == breakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *breaker) record(cb *CircuitBreaker, failed bool, now time.Time) (opened bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		if !failed {
+			b.failures = 0
+			return false
+		}
+		b.failures++
+		if b.failures < cb.FailureThreshold {
+			return false
+		}
+	case breakerHalfOpen:
+		if !failed {
+			b.successes++
+			if b.successes >= cb.SuccessThreshold {
+				b.state = breakerClosed
+				b.failures = 0
+			}
+			return false
+		}
+	default:
+		return false
+	}
+
+	b.state = breakerOpen
+	b.openUntil = now.Add(cb.OpenTimeout)
+	return true
+}
+
+func (h *Handler) circuitBreaker() *CircuitBreaker {
+	if h.CircuitBreaker == nil {
+		return nil
+	}
+	cb := *h.CircuitBreaker
+	cb.setDefaults()
+	return &cb
+}
+
+// allowTarget checks the breaker of the target before sending it a request,
+// see breaker.allow.
+func (h *Handler) allowTarget(t *Target) (done func()) {
+	cb := h.circuitBreaker()
+	if cb == nil || cb.FailureThreshold == 0 {
+		return func() {}
+	}
+	return t.runtime().breaker.allow(cb, time.Now())
+}
+
+// allowedTarget returns t if its breaker allows the request, otherwise
+// another target whose breaker does, preferring the ones not excluded. A
+// half open breaker only lets its probes through, the other requests go to
+// the remaining targets. done must be called once the request to the
+// target is done, it should be sent right away.
+func (h *Handler) allowedTarget(c *ctx.Context, t *Target, exclude map[*Target]bool) (*Target, func()) {
+	if done := h.allowTarget(t); done != nil {
+		return t, done
+	}
+
+	refused := map[*Target]bool{t: true}
+	for i := 0; i < len(h.targets()); i++ {
+		next := h.pick(c)
+		if next == nil {
+			return nil, nil
+		}
+		if refused[next] || exclude[next] {
+			continue
+		}
+		if done := h.allowTarget(next); done != nil {
+			return next, done
+		}
+		refused[next] = true
+	}
+
+	// strategies that hash the request keep picking the same target.
+	for _, next := range h.available() {
+		if refused[next] || exclude[next] {
+			continue
+		}
+		if done := h.allowTarget(next); done != nil {
+			return next, done
+		}
+	}
+	return nil, nil
+}
+
+func (t *Target) recordBreaker(h *Handler, resp *http.Response, err error) {
+	cb := h.circuitBreaker()
+	if cb == nil || cb.FailureThreshold == 0 {
+		return
+	}
+
+	failed := err != nil || resp.StatusCode >= 500
+	if t.runtime().breaker.record(cb, failed, time.Now()) {
+		t.stats.SetIncrement(stats.Key("lb_circuit_open_total", "handler", h.Name, "target", t.ID), 1)
+	}
+}
+
+// acquire reserves a slot for the request within the handler's limits. If
+// all slots are taken the request waits for one as long as the number of
+// pending requests allows it.
+func (h *Handler) acquire(r *http.Request, cb *CircuitBreaker) (release func(), reason string) {
+	if cb.MaxRequests == 0 {
+		return func() {}, ""
+	}
+
+	h.limitOnce.Do(func() {
+		h.slots = make(chan struct{}, cb.MaxRequests)
+	})
+
+	release = func() { <-h.slots }
+
+	select {
+	case h.slots <- struct{}{}:
+		return release, ""
+	default:
+	}
+
+	if cb.MaxPending == 0 {
+		return nil, ReasonMaxRequests
+	}
+
+	if atomic.AddInt64(&h.pending, 1) > int64(cb.MaxPending) {
+		atomic.AddInt64(&h.pending, -1)
+		return nil, ReasonMaxPending
+	}
+	defer atomic.AddInt64(&h.pending, -1)
+
+	timer := time.NewTimer(cb.PendingTimeout)
+	defer timer.Stop()
+
+	select {
+	case h.slots <- struct{}{}:
+		return release, ""
+	case <-timer.C:
+		return nil, ReasonMaxPending
+	case <-r.Context().Done():
+		return nil, ReasonMaxPending
+	}
+}
+
+// acquireRetry reserves one of the handler's active retries.
+func (h *Handler) acquireRetry(cb *CircuitBreaker) bool {
+	if cb == nil || cb.MaxRetries == 0 {
+		return true
+	}
+	if atomic.AddInt64(&h.activeRetries, 1) > int64(cb.MaxRetries) {
+		atomic.AddInt64(&h.activeRetries, -1)
+		return false
+	}
+	return true
+}
+
+func (h *Handler) releaseRetry(cb *CircuitBreaker) {
+	if cb == nil || cb.MaxRetries == 0 {
+		return
+	}
+	atomic.AddInt64(&h.activeRetries, -1)
+}
+
+// reject fails the request fast with the reason in a header.
+func (h *Handler) reject(c *ctx.Context, reason string) {
+	h.stats.SetIncrement(stats.Key("lb_rejected_total", "handler", h.Name, "reason", reason), 1)
+	c.SetHeader(ReasonHeader, reason)
+	c.NoneAvailable()
+}
@@ -0,0 +1,184 @@
+package lb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coldog/proxy/lb/router"
+	"github.com/coldog/proxy/lb/stats"
+)
+
+func TestBreaker_States(t *testing.T) {
+	cb := &CircuitBreaker{FailureThreshold: 2, SuccessThreshold: 2, OpenTimeout: time.Second}
+	cb.setDefaults()
+
+	b := &breaker{}
+	now := time.Now()
+
+	b.record(cb, true, now)
+	if b.allow(cb, now) == nil {
+		t.Fatal("opened before threshold")
+	}
+	if !b.record(cb, true, now) || b.allow(cb, now) != nil {
+		t.Fatal("did not open")
+	}
+
+	// half open allows a single probe.
+	later := now.Add(time.Second)
+	done := b.allow(cb, later)
+	if done == nil || b.allow(cb, later) != nil {
+		t.Fatal("half open did not limit probes")
+	}
+
+	b.record(cb, false, later)
+	done()
+	if b.allow(cb, later) == nil {
+		t.Fatal("probe not released")
+	}
+	b.record(cb, false, later)
+	if b.state != breakerClosed {
+		t.Fatal("did not close")
+	}
+}
+
+func TestBreaker_MaxRequests(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+
+	s := New(DefaultConfig())
+	s.PutHandler(&Handler{
+		Name:           "cb",
+		Routes:         []*router.Route{{Path: "/"}},
+		Targets:        []*Target{{ID: "t1", URL: ts.URL, Weight: 1}},
+		CircuitBreaker: &CircuitBreaker{MaxRequests: 1},
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		close(done)
+	}()
+
+	for i := 0; s.handler("cb").Targets[0].Inflight() != 1; i++ {
+		if i > 100 {
+			t.Fatal("request not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get(ReasonHeader) != ReasonMaxRequests {
+		t.Fatalf("expected rejection, got %d %q", w.Code, w.Header().Get(ReasonHeader))
+	}
+
+	close(release)
+	<-done
+}
+
+func TestBreaker_HalfOpenUsesOtherTargets(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	for _, strategy := range []string{"rr", "ip_hash"} {
+		s := New(DefaultConfig())
+		s.PutHandler(&Handler{
+			Name:           "cb",
+			Strategy:       strategy,
+			Routes:         []*router.Route{{Path: "/"}},
+			Targets:        []*Target{{ID: "t1", URL: ts.URL, Weight: 1}, {ID: "t2", URL: ts.URL, Weight: 1}},
+			CircuitBreaker: &CircuitBreaker{FailureThreshold: 1},
+		})
+
+		// t1 is half open with its probe in flight.
+		probing := s.handler("cb").Target("t1")
+		b := &probing.runtime().breaker
+		b.state = breakerHalfOpen
+		b.probes = 1
+
+		for i := 0; i < 10; i++ {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: expected another target to be used, got %d %q", strategy, w.Code, w.Header().Get(ReasonHeader))
+			}
+		}
+
+		// without another target the request is rejected.
+		s.RemoveTarget("cb", "t2")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get(ReasonHeader) != ReasonCircuitOpen {
+			t.Fatalf("%s: expected rejection, got %d", strategy, w.Code)
+		}
+	}
+}
+
+func TestBreaker_HalfOpenProbeReleased(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	s := New(DefaultConfig())
+	s.PutHandler(&Handler{
+		Name:           "cb",
+		Routes:         []*router.Route{{Path: "/"}},
+		Targets:        []*Target{{ID: "t1", URL: ts.URL, Weight: 1}},
+		CircuitBreaker: &CircuitBreaker{FailureThreshold: 1},
+		RetryPolicy:    &RetryPolicy{MaxBodyBytes: 4},
+	})
+
+	// the open timeout of the breaker passed, the next request is a probe.
+	b := &s.handler("cb").Target("t1").runtime().breaker
+	b.state = breakerOpen
+	b.openUntil = time.Now().Add(-time.Second)
+
+	// a chunked body over the retry limit.
+	req := httptest.NewRequest("PUT", "/", strings.NewReader("too large for a retry"))
+	req.ContentLength = -1
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the target to recover, got %d", w.Code)
+	}
+}
+
+func TestBreaker_ClientCanceled(t *testing.T) {
+	h := sample()
+	h.CircuitBreaker = &CircuitBreaker{FailureThreshold: 1}
+	target := h.Targets[0]
+	target.stats = &stats.NoOpStatsCollector{}
+
+	m := &meteredRoundTripper{
+		id:   target.ID,
+		stat: target.stats,
+		t:    target,
+		h:    h,
+		tr: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if err := r.Context().Err(); err != nil {
+				return nil, err
+			}
+			return nil, http.ErrHandlerTimeout
+		}),
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.RoundTrip((&http.Request{}).WithContext(c))
+	if h.allowTarget(target) == nil {
+		t.Fatal("breaker opened when the client went away")
+	}
+
+	m.RoundTrip((&http.Request{}).WithContext(context.Background()))
+	if h.allowTarget(target) != nil {
+		t.Fatal("breaker not opened on a failure")
+	}
+}
@@ -1,14 +1,28 @@
 package lb
 
+import (
+	"github.com/coldog/proxy/lb/stats"
+)
+
 func DefaultConfig() *Config {
 	return &Config{
 		Bind: "0.0.0.0",
 		Port: 9888,
+		AdminBind: "127.0.0.1",
+		Stats: stats.MEMORY,
 	}
 }
 
 type Config struct {
 	Bind string
 	Port int
+	AdminBind string
+	AdminPort int
+	TLS *TLSConfig
+	ACME *ACMEConfig
+	Stats stats.StatsCollectorBackend
+	StatsD *stats.StatsDConfig
+	AccessLog *AccessLogConfig
+	TrustRequestID bool
 	Store map[string]interface{}
 }
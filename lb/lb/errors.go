@@ -0,0 +1,50 @@
+package lb
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrVersionMismatch = errors.New("version mismatch")
+)
+
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+type ValidationErrors []*ValidationError
+
+func (e *ValidationErrors) Add(field, message string) {
+	*e = append(*e, &ValidationError{Field: field, Message: message})
+}
+
+// Merge appends the errors of a nested validation, prefixing each field.
+func (e *ValidationErrors) Merge(prefix string, err error) {
+	if err == nil {
+		return
+	}
+
+	if nested, ok := err.(ValidationErrors); ok {
+		for _, v := range nested {
+			e.Add(prefix+"."+v.Field, v.Message)
+		}
+		return
+	}
+
+	e.Add(prefix, err.Error())
+}
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, v := range e {
+		msgs = append(msgs, v.Error())
+	}
+	return "invalid: " + strings.Join(msgs, ", ")
+}
@@ -0,0 +1,85 @@
+package lb
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/coldog/proxy/lb/ctx"
+)
+
+const defaultDecayTime = 10 * time.Second
+
+func init() {
+	Use("p2c_ewma", stateless(P2CEWMAStrategy))
+}
+
+// ewma is a peak exponentially weighted moving average of the round trip
+// time of a target. Latency spikes are taken immediately, improvements
+// decay in over the decay time.
+type ewma struct {
+	lock  sync.Mutex
+	value float64
+	stamp time.Time
+}
+
+func (e *ewma) observe(rtt time.Duration, decay time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	now := time.Now()
+	sample := float64(rtt)
+
+	if e.stamp.IsZero() || sample > e.value {
+		e.value = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(e.stamp)) / float64(decay))
+		e.value = e.value*w + sample*(1-w)
+	}
+	e.stamp = now
+}
+
+func (e *ewma) get() float64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.value
+}
+
+func (t *Target) observeLatency(h *Handler, rtt time.Duration) {
+	decay := h.DecayTime
+	if decay <= 0 {
+		decay = defaultDecayTime
+	}
+	t.runtime().latency.observe(rtt, decay)
+}
+
+// cost weighs the average latency of the target with its load, targets
+// without any samples yet are cheap so that they are tried early.
+func (t *Target) cost() float64 {
+	return (t.runtime().latency.get() + 1) * float64(t.Inflight()+1)
+}
+
+// P2CEWMAStrategy picks two random targets and sends to the one with the
+// lower cost.
+func P2CEWMAStrategy(h *Handler, c *ctx.Context) *Target {
+	targets := h.available()
+	switch len(targets) {
+	case 0:
+		return nil
+	case 1:
+		return targets[0]
+	}
+
+	i := rand.Intn(len(targets))
+	j := rand.Intn(len(targets) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := targets[i], targets[j]
+	if b.cost() < a.cost() {
+		return b
+	}
+	return a
+}
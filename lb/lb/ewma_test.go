@@ -0,0 +1,40 @@
+package lb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coldog/proxy/lb/ctx"
+)
+
+func TestEWMA_Peak(t *testing.T) {
+	e := &ewma{}
+	e.observe(10*time.Millisecond, time.Second)
+	e.observe(100*time.Millisecond, time.Second)
+	if e.get() != float64(100*time.Millisecond) {
+		t.Fatal("peak not taken immediately")
+	}
+
+	e.stamp = e.stamp.Add(-time.Second)
+	e.observe(10*time.Millisecond, time.Second)
+	if v := e.get(); v >= float64(100*time.Millisecond) || v <= float64(10*time.Millisecond) {
+		t.Fatalf("expected decayed value, got %v", time.Duration(v))
+	}
+}
+
+func TestStrategies_P2CEWMA(t *testing.T) {
+	h := sample()
+	h.Strategy = "p2c_ewma"
+	h.Targets[0].runtime().latency.observe(500*time.Millisecond, time.Second)
+	h.Targets[1].runtime().latency.observe(5*time.Millisecond, time.Second)
+
+	for i := 0; i < 20; i++ {
+		if P2CEWMAStrategy(h, ctx.New(nil, mockReq("t", "t"))) != h.Targets[1] {
+			t.Fatal("did not pick the cheaper target")
+		}
+	}
+
+	if _, ok := strategies["p2c_ewma"]; !ok {
+		t.Fatal("strategy not registered")
+	}
+}
@@ -0,0 +1,284 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// FileConfig is the declarative configuration loaded from a json or yaml
+// file by the lb binary.
+type FileConfig struct {
+	Handlers []*Handler `json:"handlers"`
+}
+
+func ReadFile(path string) (*FileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml":
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := &FileConfig{}
+	data, err = parseDurations(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// parseDurations rewrites duration strings like "5s" to nanoseconds where
+// v has a time.Duration so that timeouts can be written readably, numbers
+// are left as they are.
+func parseDurations(data []byte, v interface{}) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc interface{}
+	err := dec.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err = convertDurations(doc, reflect.TypeOf(v), "")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func convertDurations(doc interface{}, t reflect.Type, field string) (interface{}, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch val := doc.(type) {
+	case string:
+		if t != durationType {
+			return val, nil
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, ValidationErrors{{Field: field, Message: "invalid duration " + val}}
+		}
+		return int64(d), nil
+
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return val, nil
+		}
+		for i := range val {
+			v, err := convertDurations(val[i], t.Elem(), fmt.Sprintf("%s[%d]", field, i))
+			if err != nil {
+				return nil, err
+			}
+			val[i] = v
+		}
+
+	case map[string]interface{}:
+		if t.Kind() == reflect.Map {
+			for k := range val {
+				v, err := convertDurations(val[k], t.Elem(), joinField(field, k))
+				if err != nil {
+					return nil, err
+				}
+				val[k] = v
+			}
+		} else if t.Kind() == reflect.Struct {
+			for k := range val {
+				f, ok := jsonField(t, k)
+				if !ok {
+					continue
+				}
+				v, err := convertDurations(val[k], f.Type, joinField(field, k))
+				if err != nil {
+					return nil, err
+				}
+				val[k] = v
+			}
+		}
+	}
+	return doc, nil
+}
+
+// jsonField finds the struct field that encoding/json decodes key into.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var fold reflect.StructField
+	found := false
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		if name == key {
+			return f, true
+		}
+		if !found && strings.EqualFold(name, key) {
+			fold, found = f, true
+		}
+	}
+	return fold, found
+}
+
+func joinField(field, key string) string {
+	if field == "" {
+		return key
+	}
+	return field + "." + key
+}
+
+func (f *FileConfig) Validate() error {
+	errs := ValidationErrors{}
+
+	seen := map[string]bool{}
+	for i, h := range f.Handlers {
+		field := fmt.Sprintf("handlers[%d]", i)
+		if h == nil {
+			errs.Add(field, "is empty")
+			continue
+		}
+		if seen[h.Name] {
+			errs.Add(field+".name", "duplicate name "+h.Name)
+		}
+		seen[h.Name] = true
+
+		errs.Merge(field, h.Validate())
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Loader applies a config file to a server. Only the handlers that changed
+// since the last load are replaced, and only handlers that were previously
+// loaded from the file are removed, so handlers added through the admin api
+// are left alone.
+type Loader struct {
+	Path string
+
+	server  *Server
+	lock    sync.Mutex
+	modTime time.Time
+	loaded  map[string]bool
+}
+
+func NewLoader(s *Server, path string) *Loader {
+	return &Loader{
+		Path:   path,
+		server: s,
+		loaded: map[string]bool{},
+	}
+}
+
+// Reload reads and validates the file, the running configuration is only
+// touched if the whole file is valid.
+func (l *Loader) Reload() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	info, err := os.Stat(l.Path)
+	if err != nil {
+		return err
+	}
+
+	// remember the version even if it is invalid so that a broken file
+	// is not reloaded over and over.
+	l.modTime = info.ModTime()
+
+	cfg, err := ReadFile(l.Path)
+	if err != nil {
+		return err
+	}
+
+	next := map[string]bool{}
+	for _, h := range cfg.Handlers {
+		next[h.Name] = true
+
+		current := l.server.handler(h.Name)
+		if current != nil && current.fingerprint() == h.fingerprint() {
+			continue
+		}
+
+		log.Printf("[INFO] config: applying handler %s", h.Name)
+		err = l.server.PutHandler(h)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name := range l.loaded {
+		if !next[name] {
+			log.Printf("[INFO] config: removing handler %s", name)
+			go l.server.RemoveHandler(name)
+		}
+	}
+
+	l.loaded = next
+	return nil
+}
+
+// Watch polls the file for changes and reloads it until quit is closed.
+func (l *Loader) Watch(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(l.Path)
+		if err != nil {
+			log.Printf("[ERROR] config: %v", err)
+			continue
+		}
+
+		l.lock.Lock()
+		changed := !info.ModTime().Equal(l.modTime)
+		l.lock.Unlock()
+
+		if changed {
+			err = l.Reload()
+			if err != nil {
+				log.Printf("[ERROR] config: reload failed %v", err)
+			}
+		}
+	}
+}
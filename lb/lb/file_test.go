@@ -0,0 +1,120 @@
+package lb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const fileA = `
+handlers:
+  - name: a
+    routes: [{path: /a}]
+    targets: [{id: a1, url: "http://localhost:3000", weight: 1}]
+  - name: b
+    routes: [{path: /b}]
+    targets: [{id: b1, url: "http://localhost:3001", weight: 1}]
+`
+
+const fileB = `
+handlers:
+  - name: a
+    routes: [{path: /a}]
+    targets: [{id: a1, url: "http://localhost:3000", weight: 1}]
+  - name: c
+    routes: [{path: /c}]
+    targets: [{id: c1, url: "http://localhost:3002", weight: 1}]
+`
+
+func TestLoader_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lb.yaml")
+	ioutil.WriteFile(path, []byte(fileA), 0644)
+
+	s := New(DefaultConfig())
+	l := NewLoader(s, path)
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := s.handler("a")
+	if a == nil || !s.HasHandler("b") {
+		t.Fatal("handlers not loaded")
+	}
+
+	s.PutHandler(&Handler{Name: "admin"})
+
+	ioutil.WriteFile(path, []byte(fileB), 0644)
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.handler("a") != a {
+		t.Fatal("unchanged handler was replaced")
+	}
+	if !s.HasHandler("c") || !s.HasHandler("admin") {
+		t.Fatal("handlers not applied")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if s.HasHandler("b") {
+		t.Fatal("handler not removed")
+	}
+
+	ioutil.WriteFile(path, []byte("handlers: [{name: a, strategy: nope}]"), 0644)
+	if err := l.Reload(); err == nil {
+		t.Fatal("expected validation error")
+	}
+	if s.handler("a") != a {
+		t.Fatal("invalid config was applied")
+	}
+}
+
+func TestReadFile_Durations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lb.yaml")
+	ioutil.WriteFile(path, []byte(`
+handlers:
+  - name: a
+    dial_timeout: 5s
+    read_timeout: 1500000000
+    routes: [{path: /a}]
+    targets: [{id: a1, url: "http://localhost:3000", weight: 1}]
+    health_check: {path: /health, interval: 2s, timeout: 500ms}
+    retry_policy: {max_attempts: 2, backoff_base: 10ms}
+`), 0644)
+
+	cfg, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := cfg.Handlers[0]
+	if h.DialTimeout != 5*time.Second || h.ReadTimeout != 1500*time.Millisecond {
+		t.Fatalf("unexpected timeouts %v %v", h.DialTimeout, h.ReadTimeout)
+	}
+	if h.HealthCheck.Interval != 2*time.Second || h.HealthCheck.Timeout != 500*time.Millisecond {
+		t.Fatalf("unexpected health check %v %v", h.HealthCheck.Interval, h.HealthCheck.Timeout)
+	}
+	if h.RetryPolicy.BackoffBase != 10*time.Millisecond {
+		t.Fatalf("unexpected backoff %v", h.RetryPolicy.BackoffBase)
+	}
+
+	ioutil.WriteFile(path, []byte(`handlers: [{name: a, dial_timeout: soon}]`), 0644)
+	if _, err := ReadFile(path); err == nil || !strings.Contains(err.Error(), "handlers[0].dial_timeout") {
+		t.Fatalf("expected an invalid duration error, got %v", err)
+	}
+}
@@ -4,46 +4,254 @@ import (
 	"github.com/coldog/proxy/lb/ctx"
 	"github.com/coldog/proxy/lb/router"
 
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/coldog/proxy/lb/stats"
 )
 
 type Handler struct {
-	Name                  string
-	Routes                []*router.Route
-	Strategy              string
-	Middleware            []string
-	Targets               []*Target
-	MaxConn               int
-	ShutdownWait          time.Duration
-	DialTimeout           time.Duration
-	ResponseHeaderTimeout time.Duration
-	ExpectContinueTimeout time.Duration
-	KeepAliveTimeout      time.Duration
-	ReadTimeout           time.Duration
-	DisableKeepAlives     bool
-	DisableCompression    bool
-	RawProxy              bool
-	ClientIPHeader        string
-
-	index         int
-	currentWeight int
+	Name                  string            `json:"name"`
+	Routes                []*router.Route   `json:"routes"`
+	Strategy              string            `json:"strategy"`
+	Middleware            []string          `json:"middleware"`
+	Targets               []*Target         `json:"targets"`
+	MaxConn               int               `json:"max_conn"`
+	ShutdownWait          time.Duration     `json:"shutdown_wait"`
+	DialTimeout           time.Duration     `json:"dial_timeout"`
+	ResponseHeaderTimeout time.Duration     `json:"response_header_timeout"`
+	ExpectContinueTimeout time.Duration     `json:"expect_continue_timeout"`
+	KeepAliveTimeout      time.Duration     `json:"keep_alive_timeout"`
+	ReadTimeout           time.Duration     `json:"read_timeout"`
+	DisableKeepAlives     bool              `json:"disable_keep_alives"`
+	DisableCompression    bool              `json:"disable_compression"`
+	RawProxy              bool              `json:"raw_proxy"`
+	ClientIPHeader        string            `json:"client_ip_header"`
+	DecayTime             time.Duration     `json:"decay_time"`
+	HashKey               string            `json:"hash_key"`
+	StickySession         *StickySession    `json:"sticky_session,omitempty"`
+	RetryPolicy           *RetryPolicy      `json:"retry_policy,omitempty"`
+	CircuitBreaker        *CircuitBreaker   `json:"circuit_breaker,omitempty"`
+	UpstreamTLS           *UpstreamTLS      `json:"upstream_tls,omitempty"`
+	HealthCheck           *HealthCheck      `json:"health_check,omitempty"`
+	OutlierDetection      *OutlierDetection `json:"outlier_detection,omitempty"`
+
+	version       int64
+	live          atomic.Value
+	strategy      Strategy
+	strategyOnce  sync.Once
+	budget        retryBudget
+	ejectLock     sync.Mutex
+	limitOnce     sync.Once
+	slots         chan struct{}
+	pending       int64
+	activeRetries int64
+	tlsOnce       sync.Once
+	tlsConfig     *tls.Config
+	tlsErr        error
+	active        tracker
 
 	quit      chan struct{}
-	closed    bool
-	draining  bool
+	closed    int32
+	draining  int32
 	stats     stats.StatsCollector
 }
 
 func (h *Handler) Close() {
-	close(h.quit)
-	h.closed = true
+	if atomic.CompareAndSwapInt32(&h.closed, 0, 1) {
+		close(h.quit)
+	}
+}
+
+func (h *Handler) isClosed() bool {
+	return atomic.LoadInt32(&h.closed) == 1
+}
+
+// isDraining reports whether the handler was replaced or removed, it no
+// longer admits requests but finishes the ones it already has.
+func (h *Handler) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+func (h *Handler) setDraining() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// targetSet is a snapshot of the targets of a handler, it is never
+// modified once published.
+type targetSet struct {
+	targets []*Target
+}
+
+// targets returns the current snapshot of the targets. Handlers that were
+// not added to a server yet use Targets as is.
+func (h *Handler) targets() []*Target {
+	if set, ok := h.live.Load().(*targetSet); ok {
+		return set.targets
+	}
+	return h.Targets
+}
+
+// setTargets publishes a new list of targets, the list must not be
+// modified afterwards. Changes must be serialized by the caller. Targets
+// keeps the configured targets, it is read without synchronization.
+func (h *Handler) setTargets(targets []*Target) {
+	h.live.Store(&targetSet{targets: targets})
+}
+
+// MarshalJSON writes the current targets instead of the Targets field so
+// that it is safe while the targets change.
+func (h *Handler) MarshalJSON() ([]byte, error) {
+	type config Handler
+	return json.Marshal(struct {
+		*config
+		Targets []*Target `json:"targets"`
+	}{(*config)(h), h.targets()})
 }
 
 func (h *Handler) AddTarget(t *Target) {
-	h.Targets = append(h.Targets, t)
+	targets := h.targets()
+	h.setTargets(append(targets[:len(targets):len(targets)], t))
+}
+
+func (h *Handler) Target(id string) *Target {
+	for _, t := range h.targets() {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// available returns the targets that are currently passing health checks
+// and are not ejected.
+func (h *Handler) available() []*Target {
+	all := h.targets()
+	for i, t := range all {
+		if t.Available() {
+			continue
+		}
+
+		targets := make([]*Target, i, len(all))
+		copy(targets, all[:i])
+		for _, t := range all[i+1:] {
+			if t.Available() {
+				targets = append(targets, t)
+			}
+		}
+		return targets
+	}
+	return all
+}
+
+// fingerprint serializes the configuration of the handler without any
+// runtime state so that two handlers can be compared.
+func (h *Handler) fingerprint() string {
+	type config Handler
+	type targetConfig Target
+
+	current := h.targets()
+	targets := make([]*targetConfig, 0, len(current))
+	for _, t := range current {
+		targets = append(targets, (*targetConfig)(t))
+	}
+
+	// the sticky session secret is not marshaled but a new secret must
+	// still replace the handler.
+	var secret string
+	if h.StickySession != nil {
+		secret = h.StickySession.Secret
+	}
+
+	data, _ := json.Marshal(struct {
+		*config
+		Targets      []*targetConfig `json:"targets"`
+		StickySecret string          `json:"sticky_secret,omitempty"`
+	}{(*config)(h), targets, secret})
+	return string(data)
+}
+
+func (h *Handler) Validate() error {
+	errs := ValidationErrors{}
+
+	if h.Name == "" {
+		errs.Add("name", "is required")
+	}
+
+	if _, ok := strategies[h.Strategy]; h.Strategy != "" && !ok {
+		errs.Add("strategy", "unknown strategy "+h.Strategy)
+	}
+
+	for i, r := range h.Routes {
+		if r == nil {
+			errs.Add(fmt.Sprintf("routes[%d]", i), "is empty")
+			continue
+		}
+		if err := r.Compile(); err != nil {
+			errs.Add(fmt.Sprintf("routes[%d]", i), err.Error())
+		}
+	}
+
+	if h.HealthCheck != nil {
+		errs.Merge("health_check", h.HealthCheck.Validate())
+	}
+
+	if h.OutlierDetection != nil {
+		errs.Merge("outlier_detection", h.OutlierDetection.Validate())
+	}
+
+	if h.UpstreamTLS != nil {
+		errs.Merge("upstream_tls", h.UpstreamTLS.Validate())
+	}
+
+	if h.CircuitBreaker != nil {
+		errs.Merge("circuit_breaker", h.CircuitBreaker.Validate())
+	}
+
+	if h.RetryPolicy != nil {
+		errs.Merge("retry_policy", h.RetryPolicy.Validate())
+	}
+
+	if h.StickySession != nil {
+		errs.Merge("sticky_session", h.StickySession.Validate())
+	}
+
+	if err := validateHashKey(h.HashKey); err != nil {
+		errs.Add("hash_key", err.Error())
+	}
+
+	if h.DecayTime < 0 {
+		errs.Add("decay_time", "must not be negative")
+	}
+
+	if h.MaxConn < 0 {
+		errs.Add("max_conn", "must not be negative")
+	}
+
+	seen := map[string]bool{}
+	for i, t := range h.Targets {
+		field := fmt.Sprintf("targets[%d]", i)
+		if t == nil {
+			errs.Add(field, "is empty")
+			continue
+		}
+		if seen[t.ID] {
+			errs.Add(field+".id", "duplicate id "+t.ID)
+		}
+		seen[t.ID] = true
+
+		errs.Merge(field, t.Validate())
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 func (h *Handler) Process(c *ctx.Context) error {
@@ -118,15 +326,31 @@ func (h *Handler) Process(c *ctx.Context) error {
 }
 
 func (h *Handler) Next(c *ctx.Context) *Target {
-	if h.closed || h.draining {
+	if h.isClosed() {
 		return nil
 	}
 
-	dispatcher, ok := strategies[h.Strategy]
-	if !ok {
-		dispatcher = RRStrategy
+	h.stats.SetIncrement(stats.Key("lb_requests_total", "handler", h.Name), 1)
+
+	// the affinity cookie is set by the target that ends up serving the
+	// request, which may be another one after retries.
+	if h.StickySession != nil {
+		if t := h.stickyTarget(c); t != nil {
+			return t
+		}
 	}
+	return h.pick(c)
+}
 
-	h.stats.SetIncrement("requests." + h.Name, 1)
-	return dispatcher(h, c)
+// pick selects a target with the handler's strategy, which is created
+// the first time it is used.
+func (h *Handler) pick(c *ctx.Context) *Target {
+	h.strategyOnce.Do(func() {
+		newStrategy, ok := strategies[h.Strategy]
+		if !ok {
+			newStrategy = NewRR
+		}
+		h.strategy = newStrategy()
+	})
+	return h.strategy.Pick(h, c)
 }
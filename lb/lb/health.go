@@ -0,0 +1,177 @@
+package lb
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coldog/proxy/lb/stats"
+)
+
+type HealthCheck struct {
+	Path               string        `json:"path"`
+	Interval           time.Duration `json:"interval"`
+	Timeout            time.Duration `json:"timeout"`
+	StatusMin          int           `json:"status_min"`
+	StatusMax          int           `json:"status_max"`
+	HealthyThreshold   int           `json:"healthy_threshold"`
+	UnhealthyThreshold int           `json:"unhealthy_threshold"`
+}
+
+func (hc *HealthCheck) setDefaults() {
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = 10 * time.Second
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 5 * time.Second
+	}
+	if hc.StatusMin == 0 {
+		hc.StatusMin = 200
+	}
+	if hc.StatusMax == 0 {
+		hc.StatusMax = 299
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = 3
+	}
+}
+
+func (hc *HealthCheck) Validate() error {
+	errs := ValidationErrors{}
+
+	if hc.Path != "" && hc.Path[0] != '/' {
+		errs.Add("path", "must start with /")
+	}
+	if hc.Interval < 0 {
+		errs.Add("interval", "must not be negative")
+	}
+	if hc.Timeout < 0 {
+		errs.Add("timeout", "must not be negative")
+	}
+	if hc.StatusMax != 0 && hc.StatusMin > hc.StatusMax {
+		errs.Add("status_min", "must not be greater than status_max")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// healthCheck runs the active health checks for a handler until the
+// handler is closed.
+func (s *Server) healthCheck(h *Handler) {
+	hc := *h.HealthCheck
+	hc.setDefaults()
+
+	client, err := h.healthClient(&hc)
+	if err != nil {
+		log.Printf("[ERROR] health checks for %s disabled. %v", h.Name, err)
+		return
+	}
+	defer client.CloseIdleConnections()
+
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	for {
+		targets := h.targets()
+
+		wg := sync.WaitGroup{}
+		for _, t := range targets {
+			wg.Add(1)
+			go func(t *Target) {
+				defer wg.Done()
+				t.check(client, &hc)
+			}(t)
+		}
+		wg.Wait()
+
+		select {
+		case <-h.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// healthClient returns the client for the health checks, it connects to
+// the targets with the same tls configuration as the proxy.
+func (h *Handler) healthClient(hc *HealthCheck) (*http.Client, error) {
+	cfg, err := h.upstreamTLS()
+	if err != nil {
+		return nil, fmt.Errorf("upstream tls: %v", err)
+	}
+
+	return &http.Client{
+		Timeout: hc.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   cfg,
+			DisableKeepAlives: h.DisableKeepAlives,
+		},
+	}, nil
+}
+
+func (t *Target) check(client *http.Client, hc *HealthCheck) {
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return
+	}
+
+	ok := false
+	resp, err := client.Get(u.Scheme + "://" + u.Host + hc.Path)
+	if err == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		ok = resp.StatusCode >= hc.StatusMin && resp.StatusCode <= hc.StatusMax
+	}
+
+	state := t.runtime()
+	state.checkLock.Lock()
+	defer state.checkLock.Unlock()
+
+	if ok {
+		state.checkFails = 0
+		state.checkPasses++
+		if !t.Healthy() && state.checkPasses >= hc.HealthyThreshold {
+			atomic.StoreInt32(&state.unhealthy, 0)
+			t.stats.SetIncrement(stats.Key("lb_health_changes_total", "handler", t.handler, "target", t.ID, "state", "up"), 1)
+			log.Printf("[INFO] target %s is healthy", t.ID)
+		}
+	} else {
+		state.checkPasses = 0
+		state.checkFails++
+		if t.Healthy() && state.checkFails >= hc.UnhealthyThreshold {
+			atomic.StoreInt32(&state.unhealthy, 1)
+			t.stats.SetIncrement(stats.Key("lb_health_changes_total", "handler", t.handler, "target", t.ID, "state", "down"), 1)
+			log.Printf("[INFO] target %s is unhealthy %v", t.ID, err)
+		}
+	}
+}
+
+func (t *Target) Healthy() bool {
+	return atomic.LoadInt32(&t.runtime().unhealthy) == 0
+}
+
+func (t *Target) Ejected() bool {
+	return t.runtime().outlier.ejected(time.Now())
+}
+
+// Available reports whether the target passes health checks, is not
+// ejected by outlier detection, has no open circuit breaker and is not
+// draining.
+func (t *Target) Available() bool {
+	return !t.Draining && t.Healthy() && !t.Ejected() && !t.runtime().breaker.open(time.Now())
+}
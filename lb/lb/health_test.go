@@ -0,0 +1,96 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coldog/proxy/lb/ctx"
+	"github.com/coldog/proxy/lb/router"
+	"github.com/coldog/proxy/lb/stats"
+)
+
+func TestHealth_Thresholds(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	hc := &HealthCheck{Path: "/health", HealthyThreshold: 2, UnhealthyThreshold: 2}
+	hc.setDefaults()
+
+	target := &Target{ID: "t1", URL: ts.URL, stats: &stats.NoOpStatsCollector{}}
+
+	status = http.StatusInternalServerError
+	target.check(ts.Client(), hc)
+	if !target.Healthy() {
+		t.Fatal("target marked down before threshold")
+	}
+	target.check(ts.Client(), hc)
+	if target.Healthy() {
+		t.Fatal("target not marked down")
+	}
+
+	status = http.StatusOK
+	target.check(ts.Client(), hc)
+	target.check(ts.Client(), hc)
+	if !target.Healthy() {
+		t.Fatal("target not marked up")
+	}
+}
+
+func TestHealth_StrategiesSkipUnhealthy(t *testing.T) {
+	h := sample()
+	h.Targets[0].runtime().unhealthy = 1
+
+	for name, newStrategy := range strategies {
+		strategy := newStrategy()
+		for i := 0; i < 10; i++ {
+			target := strategy.Pick(h, ctx.New(nil, mockReq("t", "t")))
+			if target == nil || target.ID != "test-2" {
+				t.Fatalf("%s picked an unhealthy target", name)
+			}
+		}
+	}
+
+	h.Targets[1].runtime().unhealthy = 1
+	for name, newStrategy := range strategies {
+		if newStrategy().Pick(h, ctx.New(nil, mockReq("t", "t"))) != nil {
+			t.Fatalf("%s picked an unhealthy target", name)
+		}
+	}
+}
+
+func TestHealth_PutSameHandler(t *testing.T) {
+	var checks int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&checks, 1)
+	}))
+	defer ts.Close()
+
+	s := New(DefaultConfig())
+	h := &Handler{
+		Name:        "api",
+		Routes:      []*router.Route{{Path: "/api"}},
+		Targets:     []*Target{{ID: "t1", URL: ts.URL, Weight: 1}},
+		HealthCheck: &HealthCheck{Interval: time.Minute},
+	}
+	if err := s.PutHandler(h); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutHandler(h); err != nil {
+		t.Fatal(err)
+	}
+	defer s.RemoveHandler("api")
+
+	for i := 0; i < 100 && atomic.LoadInt32(&checks) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&checks); n != 1 {
+		t.Fatalf("expected a single health check, got %d", n)
+	}
+}
@@ -0,0 +1,66 @@
+package lb
+
+import (
+	"bufio"
+	"net/http"
+	"time"
+
+	"github.com/coldog/proxy/lb/stats"
+)
+
+// Metrics returns an http handler that writes the collected stats and the
+// current state of every handler and target in the Prometheus text format.
+func (s *Server) Metrics() http.Handler {
+	return http.HandlerFunc(s.serveMetrics)
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		adminError(w, http.StatusMethodNotAllowed, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
+	}
+
+	buf := bufio.NewWriter(w)
+	defer buf.Flush()
+
+	if e, ok := s.Stats.(stats.Exporter); ok {
+		e.WritePrometheus(buf)
+	}
+	stats.WriteMetric(buf, "gauge", s.gauges())
+}
+
+// gauges samples the in flight requests, health and ejection state of the
+// handlers and targets.
+func (s *Server) gauges() map[string]float64 {
+	now := time.Now()
+	g := map[string]float64{}
+	for _, h := range s.handlerMap() {
+		g[stats.Key("lb_handler_active", "handler", h.Name)] = float64(h.active.count())
+		targets := h.targets()
+		g[stats.Key("lb_handler_targets", "handler", h.Name)] = float64(len(targets))
+		g[stats.Key("lb_handler_available_targets", "handler", h.Name)] = float64(len(h.available()))
+
+		for _, t := range targets {
+			labels := []string{"handler", h.Name, "target", t.ID}
+			g[stats.Key("lb_target_inflight", labels...)] = float64(t.Inflight())
+			g[stats.Key("lb_target_healthy", labels...)] = boolGauge(t.Healthy())
+			g[stats.Key("lb_target_ejected", labels...)] = boolGauge(t.Ejected())
+			g[stats.Key("lb_target_circuit_open", labels...)] = boolGauge(t.runtime().breaker.open(now))
+			g[stats.Key("lb_target_draining", labels...)] = boolGauge(t.Draining)
+			g[stats.Key("lb_target_weight", labels...)] = float64(t.Weight)
+		}
+	}
+	return g
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,52 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coldog/proxy/lb/router"
+)
+
+func TestMetrics_Prometheus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	s := New(DefaultConfig())
+	s.PutHandler(&Handler{
+		Name:    "api",
+		Routes:  []*router.Route{{Path: "/"}},
+		Targets: []*Target{{ID: "t1", URL: ts.URL, Weight: 1}},
+	})
+
+	for i := 0; i < 3; i++ {
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	w := adminReq(s, "GET", "/metrics", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+
+	for _, line := range []string{
+		`lb_requests_total{handler="api"} 3`,
+		`lb_upstream_responses_total{handler="api",target="t1",code="2xx"} 3`,
+		`lb_upstream_duration_seconds_bucket{handler="api",target="t1",le="+Inf"} 3`,
+		`lb_upstream_duration_seconds_count{handler="api",target="t1"} 3`,
+		`lb_target_healthy{handler="api",target="t1"} 1`,
+		`lb_target_inflight{handler="api",target="t1"} 0`,
+		`lb_target_ejected{handler="api",target="t1"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+
+	if strings.Count(body, "# TYPE lb_target_healthy gauge") != 1 {
+		t.Errorf("expected a single type line:\n%s", body)
+	}
+}
@@ -0,0 +1,212 @@
+package lb
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coldog/proxy/lb/ctx"
+	"github.com/coldog/proxy/lb/stats"
+)
+
+// OutlierDetection ejects targets passively based on the results of
+// proxied requests. A zero value for any of the detectors disables it.
+type OutlierDetection struct {
+	Consecutive5xx            int           `json:"consecutive_5xx"`
+	ConsecutiveGatewayFailure int           `json:"consecutive_gateway_failure"`
+	ErrorRate                 int           `json:"error_rate"`
+	ErrorRateMinRequests      int           `json:"error_rate_min_requests"`
+	Window                    time.Duration `json:"window"`
+	BaseEjectionTime          time.Duration `json:"base_ejection_time"`
+	MaxEjectionTime           time.Duration `json:"max_ejection_time"`
+	MaxEjectionPercent        int           `json:"max_ejection_percent"`
+}
+
+func (o *OutlierDetection) setDefaults() {
+	if o.ErrorRateMinRequests <= 0 {
+		o.ErrorRateMinRequests = 10
+	}
+	if o.Window <= 0 {
+		o.Window = 10 * time.Second
+	}
+	if o.BaseEjectionTime <= 0 {
+		o.BaseEjectionTime = 30 * time.Second
+	}
+	if o.MaxEjectionTime <= 0 {
+		o.MaxEjectionTime = 300 * time.Second
+	}
+	if o.MaxEjectionPercent <= 0 {
+		o.MaxEjectionPercent = 10
+	}
+}
+
+func (o *OutlierDetection) Validate() error {
+	errs := ValidationErrors{}
+
+	if o.Consecutive5xx < 0 {
+		errs.Add("consecutive_5xx", "must not be negative")
+	}
+	if o.ConsecutiveGatewayFailure < 0 {
+		errs.Add("consecutive_gateway_failure", "must not be negative")
+	}
+	if o.ErrorRate < 0 || o.ErrorRate > 100 {
+		errs.Add("error_rate", "must be between 0 and 100")
+	}
+	if o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100 {
+		errs.Add("max_ejection_percent", "must be between 0 and 100")
+	}
+	if o.MaxEjectionTime > 0 && o.MaxEjectionTime < o.BaseEjectionTime {
+		errs.Add("max_ejection_time", "must not be less than base_ejection_time")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+type outlier struct {
+	lock sync.Mutex
+
+	consecutive5xx     int
+	consecutiveGateway int
+
+	windowStart    time.Time
+	windowRequests int
+	windowErrors   int
+
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func (o *outlier) ejected(now time.Time) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return now.Before(o.ejectedUntil)
+}
+
+// clientCanceled reports whether the request failed because the client
+// went away or timed out, which says nothing about the target. The attempt
+// may run with a shorter per try timeout so the context of the client
+// request is checked.
+func clientCanceled(r *http.Request, err error) bool {
+	if err == nil {
+		return false
+	}
+	if c := ctx.From(r); c != nil {
+		r = c.Req
+	}
+	return r.Context().Err() != nil
+}
+
+// observe records the result of a proxied request and ejects the target
+// if one of the configured detectors trips.
+func (t *Target) observe(h *Handler, resp *http.Response, err error) {
+	if h.OutlierDetection == nil {
+		return
+	}
+
+	od := *h.OutlierDetection
+	od.setDefaults()
+
+	now := time.Now()
+	failed := err != nil || resp.StatusCode >= 500
+	gateway := err != nil || resp.StatusCode == 502 || resp.StatusCode == 503 || resp.StatusCode == 504
+
+	o := &t.runtime().outlier
+	o.lock.Lock()
+
+	if now.Sub(o.windowStart) > od.Window {
+		o.windowStart = now
+		o.windowRequests = 0
+		o.windowErrors = 0
+	}
+
+	o.windowRequests++
+	if failed {
+		o.windowErrors++
+		o.consecutive5xx++
+	} else {
+		o.consecutive5xx = 0
+	}
+
+	if gateway {
+		o.consecutiveGateway++
+	} else {
+		o.consecutiveGateway = 0
+	}
+
+	reason := ""
+	switch {
+	case now.Before(o.ejectedUntil):
+	case od.Consecutive5xx > 0 && o.consecutive5xx >= od.Consecutive5xx:
+		reason = "consecutive_5xx"
+	case od.ConsecutiveGatewayFailure > 0 && o.consecutiveGateway >= od.ConsecutiveGatewayFailure:
+		reason = "consecutive_gateway_failure"
+	case od.ErrorRate > 0 && o.windowRequests >= od.ErrorRateMinRequests &&
+		o.windowErrors*100 >= od.ErrorRate*o.windowRequests:
+		reason = "error_rate"
+	}
+	o.lock.Unlock()
+
+	if reason == "" {
+		return
+	}
+
+	// the ejected targets are counted and the target ejected under the
+	// handler's lock so concurrent failures can't go over the limit.
+	h.ejectLock.Lock()
+	defer h.ejectLock.Unlock()
+
+	if !h.canEject(now, &od) {
+		t.stats.SetIncrement(stats.Key("lb_ejections_overflow_total", "handler", h.Name), 1)
+		return
+	}
+
+	o.lock.Lock()
+	// ejection back-off is reset once a target has stayed in for longer
+	// than the maximum ejection time.
+	if now.Sub(o.ejectedUntil) > od.MaxEjectionTime {
+		o.ejections = 0
+	}
+	o.ejections++
+
+	d := od.BaseEjectionTime
+	for i := 1; i < o.ejections && d < od.MaxEjectionTime; i++ {
+		d *= 2
+	}
+	if d > od.MaxEjectionTime {
+		d = od.MaxEjectionTime
+	}
+
+	o.ejectedUntil = now.Add(d)
+	o.consecutive5xx = 0
+	o.consecutiveGateway = 0
+	o.windowStart = now
+	o.windowRequests = 0
+	o.windowErrors = 0
+	o.lock.Unlock()
+
+	t.stats.SetIncrement(stats.Key("lb_ejections_total", "handler", h.Name, "target", t.ID, "reason", reason), 1)
+	log.Printf("[INFO] target %s ejected for %v: %s", t.ID, d, reason)
+}
+
+// canEject checks whether another target can be ejected without going
+// over the max ejection percent. At least one target may be ejected. Must
+// be called with the eject lock held.
+func (h *Handler) canEject(now time.Time, od *OutlierDetection) bool {
+	targets := h.targets()
+	ejected := 0
+	for _, t := range targets {
+		if t.runtime().outlier.ejected(now) {
+			ejected++
+		}
+	}
+
+	max := len(targets) * od.MaxEjectionPercent / 100
+	if max < 1 {
+		max = 1
+	}
+	return ejected < max
+}
@@ -0,0 +1,133 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coldog/proxy/lb/stats"
+)
+
+func TestOutlier_Consecutive5xx(t *testing.T) {
+	h := sample()
+	h.OutlierDetection = &OutlierDetection{Consecutive5xx: 3, MaxEjectionPercent: 50}
+	for _, target := range h.Targets {
+		target.stats = &stats.NoOpStatsCollector{}
+	}
+
+	target := h.Targets[0]
+	fail := &http.Response{StatusCode: 500}
+
+	target.observe(h, fail, nil)
+	target.observe(h, &http.Response{StatusCode: 200}, nil)
+	target.observe(h, fail, nil)
+	target.observe(h, fail, nil)
+	if target.Ejected() {
+		t.Fatal("ejected before threshold")
+	}
+
+	target.observe(h, fail, nil)
+	if !target.Ejected() {
+		t.Fatal("target not ejected")
+	}
+
+	if next := h.available(); len(next) != 1 || next[0] != h.Targets[1] {
+		t.Fatal("ejected target still available")
+	}
+
+	// the max ejection percent keeps the second target in.
+	for i := 0; i < 3; i++ {
+		h.Targets[1].observe(h, nil, http.ErrHandlerTimeout)
+	}
+	if h.Targets[1].Ejected() {
+		t.Fatal("ejected over max ejection percent")
+	}
+}
+
+func TestOutlier_Backoff(t *testing.T) {
+	h := sample()
+	h.OutlierDetection = &OutlierDetection{ConsecutiveGatewayFailure: 1, BaseEjectionTime: time.Second, MaxEjectionTime: 3 * time.Second}
+	target := h.Targets[0]
+	target.stats = &stats.NoOpStatsCollector{}
+
+	expect := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	for _, d := range expect {
+		target.runtime().outlier.ejectedUntil = time.Now().Add(-time.Millisecond)
+
+		start := time.Now()
+		target.observe(h, &http.Response{StatusCode: 503}, nil)
+
+		got := target.runtime().outlier.ejectedUntil.Sub(start)
+		if got < d || got > d+time.Second/2 {
+			t.Fatalf("expected ejection of %v, got %v", d, got)
+		}
+	}
+}
+
+func TestOutlier_ConcurrentMaxEjectionPercent(t *testing.T) {
+	for round := 0; round < 50; round++ {
+		h := &Handler{
+			Name:             "outlier",
+			OutlierDetection: &OutlierDetection{ConsecutiveGatewayFailure: 1, MaxEjectionPercent: 20},
+		}
+		for i := 0; i < 10; i++ {
+			h.Targets = append(h.Targets, &Target{ID: fmt.Sprintf("t%d", i), stats: &stats.NoOpStatsCollector{}})
+		}
+
+		start := make(chan struct{})
+		wg := sync.WaitGroup{}
+		for _, target := range h.Targets {
+			wg.Add(1)
+			go func(target *Target) {
+				defer wg.Done()
+				<-start
+				target.observe(h, nil, http.ErrHandlerTimeout)
+			}(target)
+		}
+		close(start)
+		wg.Wait()
+
+		if n := len(h.Targets) - len(h.available()); n > 2 {
+			t.Fatalf("%d targets ejected over the max ejection percent", n)
+		}
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestOutlier_ClientCanceled(t *testing.T) {
+	h := sample()
+	h.OutlierDetection = &OutlierDetection{ConsecutiveGatewayFailure: 1, MaxEjectionPercent: 100}
+	target := h.Targets[0]
+	target.stats = &stats.NoOpStatsCollector{}
+
+	m := &meteredRoundTripper{
+		id:   target.ID,
+		stat: target.stats,
+		t:    target,
+		h:    h,
+		tr: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if err := r.Context().Err(); err != nil {
+				return nil, err
+			}
+			return nil, http.ErrHandlerTimeout
+		}),
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.RoundTrip((&http.Request{}).WithContext(c))
+	if target.Ejected() {
+		t.Fatal("target ejected when the client went away")
+	}
+
+	m.RoundTrip((&http.Request{}).WithContext(context.Background()))
+	if !target.Ejected() {
+		t.Fatal("target not ejected on a failure")
+	}
+}
@@ -0,0 +1,59 @@
+package lb
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/coldog/proxy/lb/ctx"
+)
+
+const maxRequestIDLength = 128
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// validRequestID only accepts ids that are safe to put in headers, logs
+// and json bodies as is.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '+', c == '=', c == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the id of the request, the incoming one is kept if
+// the server trusts its clients and it is valid. The id is set on the
+// request so it is forwarded to targets.
+func (s *Server) requestID(r *http.Request) string {
+	id := r.Header.Get(ctx.RequestIDHeader)
+	if !s.config.TrustRequestID || !validRequestID(id) {
+		id = newRequestID()
+	}
+	r.Header.Set(ctx.RequestIDHeader, id)
+	return id
+}
+
+// requestLog logs a line about a request along with its request id.
+func requestLog(r *http.Request, format string, v ...interface{}) {
+	if c := ctx.From(r); c != nil && c.RequestID != "" {
+		format += " request_id=%s"
+		v = append(v, c.RequestID)
+	}
+	log.Printf(format, v...)
+}
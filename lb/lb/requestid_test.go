@@ -0,0 +1,73 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coldog/proxy/lb/ctx"
+	"github.com/coldog/proxy/lb/router"
+)
+
+func TestRequestID_Propagation(t *testing.T) {
+	var forwarded string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(ctx.RequestIDHeader)
+		w.Header().Set(ctx.RequestIDHeader, "from-target")
+	}))
+	defer ts.Close()
+
+	s := New(DefaultConfig())
+	s.PutHandler(&Handler{
+		Name:    "api",
+		Routes:  []*router.Route{{Path: "/api"}},
+		Targets: []*Target{{ID: "t1", URL: ts.URL, Weight: 1}},
+	})
+
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set(ctx.RequestIDHeader, "client")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+
+	id := w.Header().Get(ctx.RequestIDHeader)
+	if id == "client" || !validRequestID(id) {
+		t.Fatalf("expected a generated id, got %q", id)
+	}
+	if forwarded != id {
+		t.Fatalf("expected %q to be forwarded, got %q", id, forwarded)
+	}
+	if ids := w.Header()[ctx.RequestIDHeader]; len(ids) != 1 {
+		t.Fatalf("expected a single id in the response, got %q", ids)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+	id = w.Header().Get(ctx.RequestIDHeader)
+	if id == "" || !strings.Contains(w.Body.String(), `"request_id": "`+id+`"`) {
+		t.Fatalf("expected %q in the error body %s", id, w.Body.String())
+	}
+}
+
+func TestRequestID_Trusted(t *testing.T) {
+	c := DefaultConfig()
+	c.TrustRequestID = true
+	s := New(c)
+
+	for incoming, keep := range map[string]bool{
+		"abc-123":                true,
+		"bad id":                 false,
+		`"quoted"`:               false,
+		strings.Repeat("a", 200): false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(ctx.RequestIDHeader, incoming)
+		id := s.requestID(req)
+		if (id == incoming) != keep {
+			t.Errorf("%q: unexpected id %q", incoming, id)
+		}
+		if req.Header.Get(ctx.RequestIDHeader) != id {
+			t.Errorf("%q: id not set on the request", incoming)
+		}
+	}
+}
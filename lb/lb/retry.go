@@ -0,0 +1,417 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coldog/proxy/lb/ctx"
+	"github.com/coldog/proxy/lb/stats"
+)
+
+const (
+	RetryConnectFailure = "connect_failure"
+	RetryTimeout        = "timeout"
+	RetryReset          = "reset"
+)
+
+var errRetriableStatus = errors.New("retriable status")
+
+// RetryPolicy retries failed requests on a different target. Retries are
+// bounded by a budget so they cannot amplify an outage: on top of a minimum
+// of retries per second, only a percentage of requests may be retried.
+type RetryPolicy struct {
+	MaxAttempts         int           `json:"max_attempts"`
+	RetryOn             []string      `json:"retry_on"`
+	StatusCodes         []int         `json:"status_codes"`
+	PerTryTimeout       time.Duration `json:"per_try_timeout"`
+	BackoffBase         time.Duration `json:"backoff_base"`
+	BackoffMax          time.Duration `json:"backoff_max"`
+	RetryNonIdempotent  bool          `json:"retry_non_idempotent"`
+	MaxBodyBytes        int64         `json:"max_body_bytes"`
+	BudgetPercent       int           `json:"budget_percent"`
+	MinRetriesPerSecond int           `json:"min_retries_per_second"`
+}
+
+func (p *RetryPolicy) setDefaults() {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 2
+	}
+	if p.RetryOn == nil {
+		p.RetryOn = []string{RetryConnectFailure}
+	}
+	if p.StatusCodes == nil {
+		p.StatusCodes = []int{502, 503}
+	}
+	if p.BackoffBase <= 0 {
+		p.BackoffBase = 25 * time.Millisecond
+	}
+	if p.BackoffMax <= 0 {
+		p.BackoffMax = 10 * p.BackoffBase
+	}
+	if p.BudgetPercent <= 0 {
+		p.BudgetPercent = 20
+	}
+	if p.MinRetriesPerSecond <= 0 {
+		p.MinRetriesPerSecond = 10
+	}
+}
+
+func (p *RetryPolicy) Validate() error {
+	errs := ValidationErrors{}
+
+	if p.MaxAttempts < 0 {
+		errs.Add("max_attempts", "must not be negative")
+	}
+	for _, on := range p.RetryOn {
+		switch on {
+		case RetryConnectFailure, RetryTimeout, RetryReset:
+		default:
+			errs.Add("retry_on", "unknown error class "+on)
+		}
+	}
+	for _, code := range p.StatusCodes {
+		if code < 100 || code > 599 {
+			errs.Add("status_codes", "invalid status code")
+		}
+	}
+	if p.PerTryTimeout < 0 {
+		errs.Add("per_try_timeout", "must not be negative")
+	}
+	if p.BudgetPercent < 0 || p.BudgetPercent > 100 {
+		errs.Add("budget_percent", "must be between 0 and 100")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *RetryPolicy) retryStatus(code int) bool {
+	for _, c := range p.StatusCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) retryError(err error) bool {
+	class := errorClass(err)
+	for _, on := range p.RetryOn {
+		if on == class {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	d := p.BackoffBase
+	for i := 1; i < n && d < p.BackoffMax; i++ {
+		d *= 2
+	}
+	if d > p.BackoffMax {
+		d = p.BackoffMax
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+func errorClass(err error) string {
+	if op, ok := err.(*net.OpError); ok && op.Op == "dial" {
+		return RetryConnectFailure
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return RetryTimeout
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return RetryTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return RetryConnectFailure
+	}
+	if errors.Is(err, syscall.ECONNRESET) || err == io.EOF || err == io.ErrUnexpectedEOF ||
+		strings.Contains(err.Error(), "connection reset") {
+		return RetryReset
+	}
+	return ""
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// retryBudget counts requests and retries over a sliding window of ten
+// one second buckets.
+type retryBudget struct {
+	lock     sync.Mutex
+	second   int64
+	requests [10]int
+	retries  [10]int
+}
+
+func (b *retryBudget) advance(now int64) {
+	if now-b.second >= int64(len(b.requests)) {
+		b.requests = [10]int{}
+		b.retries = [10]int{}
+	} else {
+		for s := b.second + 1; s <= now; s++ {
+			b.requests[s%10] = 0
+			b.retries[s%10] = 0
+		}
+	}
+	if now > b.second {
+		b.second = now
+	}
+}
+
+func (b *retryBudget) deposit() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.advance(time.Now().Unix())
+	b.requests[b.second%10]++
+}
+
+func (b *retryBudget) withdraw(p *RetryPolicy) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.advance(time.Now().Unix())
+
+	requests, retries := 0, 0
+	for i := range b.requests {
+		requests += b.requests[i]
+		retries += b.retries[i]
+	}
+
+	if retries >= p.MinRetriesPerSecond*len(b.requests)+requests*p.BudgetPercent/100 {
+		return false
+	}
+	b.retries[b.second%10]++
+	return true
+}
+
+type attemptKey struct{}
+
+// attempt carries the state of a single try through the reverse proxy.
+// When the try may be retried and retry reserves the next try, the error
+// handler records the failure instead of writing a response to the client.
+type attempt struct {
+	policy   *RetryPolicy
+	canRetry bool
+	retry    func() bool
+	failed   bool
+}
+
+func attemptFrom(r *http.Request) *attempt {
+	a, _ := r.Context().Value(attemptKey{}).(*attempt)
+	return a
+}
+
+func proxyModifyResponse(resp *http.Response) error {
+	// the request id of the load balancer replaces one set by the target.
+	resp.Header.Del(ctx.RequestIDHeader)
+
+	a := attemptFrom(resp.Request)
+	if a != nil && a.canRetry && a.policy.retryStatus(resp.StatusCode) && a.retry() {
+		return errRetriableStatus
+	}
+	return nil
+}
+
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	a := attemptFrom(r)
+	// errRetriableStatus is only returned once the retry is reserved.
+	if a != nil && (err == errRetriableStatus || a.canRetry && a.policy.retryError(err) && a.retry()) {
+		a.failed = true
+		return
+	}
+
+	requestLog(r, "[ERROR] proxy error for %s. %s", r.URL, err)
+	if c := ctx.From(r); c != nil {
+		c.WithStatus(http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// proxy sends the request to the target, retrying on other targets as
+// allowed by the handler's retry policy.
+func (h *Handler) proxy(c *ctx.Context, t *Target) {
+	w, r := c.Writer, c.Req
+
+	cb := h.circuitBreaker()
+	if cb != nil {
+		release, reason := h.acquire(r, cb)
+		if reason != "" {
+			h.reject(c, reason)
+			return
+		}
+		defer release()
+	}
+
+	if h.RetryPolicy == nil || h.RawProxy || r.Header.Get("Upgrade") == "websocket" {
+		t, done := h.allowedTarget(c, t, nil)
+		if t == nil {
+			h.reject(c, ReasonCircuitOpen)
+			return
+		}
+		h.send(t, done, w, r)
+		return
+	}
+
+	policy := *h.RetryPolicy
+	policy.setDefaults()
+	h.budget.deposit()
+
+	replayable := idempotent(r.Method) || policy.RetryNonIdempotent
+	var body []byte
+	if replayable && r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		if policy.MaxBodyBytes <= 0 || r.ContentLength > policy.MaxBodyBytes {
+			replayable = false
+		} else {
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(r.Body, policy.MaxBodyBytes+1))
+			if err != nil {
+				r.Body.Close()
+				requestLog(r, "[ERROR] failed to read the request body. %s", err)
+				c.WithStatus(http.StatusBadRequest)
+				return
+			}
+
+			if int64(len(body)) > policy.MaxBodyBytes {
+				// a chunked body over the limit is sent once, starting
+				// with the part that was read already.
+				replayable = false
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+				body = nil
+			} else {
+				r.Body.Close()
+			}
+		}
+	}
+
+	retrying := false
+	defer func() {
+		if retrying {
+			h.releaseRetry(cb)
+		}
+	}()
+
+	tried := map[*Target]bool{}
+	for n := 1; ; n++ {
+		// the breaker is checked right before sending so that a probe of
+		// a half open breaker is always given back.
+		var done func()
+		t, done = h.allowedTarget(c, t, tried)
+		if t == nil {
+			h.reject(c, ReasonCircuitOpen)
+			return
+		}
+		tried[t] = true
+
+		// the next try is reserved before a failed response is dropped, if
+		// that is not possible the response of this try is passed through.
+		var next *Target
+		a := &attempt{
+			policy:   &policy,
+			canRetry: replayable && n < policy.MaxAttempts,
+			retry: func() bool {
+				if !retrying {
+					if !h.acquireRetry(cb) {
+						h.stats.SetIncrement(stats.Key("lb_rejected_total", "handler", h.Name, "reason", ReasonMaxRetries), 1)
+						return false
+					}
+					retrying = true
+				}
+				next = h.retryTarget(c, tried)
+				if next == nil || !h.budget.withdraw(&policy) {
+					h.stats.SetIncrement(stats.Key("lb_retries_exhausted_total", "handler", h.Name), 1)
+					return false
+				}
+				return true
+			},
+		}
+
+		parent := r.Context()
+		var cancel context.CancelFunc = func() {}
+		if policy.PerTryTimeout > 0 {
+			parent, cancel = context.WithTimeout(parent, policy.PerTryTimeout)
+		}
+
+		req := r.WithContext(context.WithValue(parent, attemptKey{}, a))
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		h.send(t, done, w, req)
+		cancel()
+
+		if !a.failed {
+			return
+		}
+
+		if !sleepContext(r.Context(), policy.backoff(n)) {
+			requestLog(r, "[INFO] retry for %s abandoned. %s", r.URL, r.Context().Err())
+			c.WithStatus(http.StatusBadGateway)
+			return
+		}
+
+		h.stats.SetIncrement(stats.Key("lb_retries_total", "handler", h.Name), 1)
+		c.Retries++
+		t = next
+	}
+}
+
+// send proxies the request to the target and then calls done, also if the
+// proxy aborts the request.
+func (h *Handler) send(t *Target, done func(), w http.ResponseWriter, r *http.Request) {
+	defer done()
+	t.ServeHTTP(h, w, r)
+}
+
+// sleepContext waits for d, it returns false if the context is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryTarget picks the next target, preferring one that was not tried
+// yet for this request.
+func (h *Handler) retryTarget(c *ctx.Context, tried map[*Target]bool) *Target {
+	var t *Target
+	for i := 0; i < len(h.targets()); i++ {
+		t = h.pick(c)
+		if t == nil || !tried[t] {
+			break
+		}
+	}
+	return t
+}
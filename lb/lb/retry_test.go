@@ -0,0 +1,174 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/coldog/proxy/lb/router"
+)
+
+func retryServer(t *testing.T, policy *RetryPolicy, urls ...string) *Server {
+	s := New(DefaultConfig())
+	h := &Handler{
+		Name:        "retry",
+		Routes:      []*router.Route{{Path: "/"}},
+		Strategy:    "rr",
+		RetryPolicy: policy,
+	}
+	for i, u := range urls {
+		h.Targets = append(h.Targets, &Target{ID: string(rune('a' + i)), URL: u, Weight: 1})
+	}
+	if err := s.PutHandler(h); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRetry_ConnectFailure(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer ok.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	s := retryServer(t, &RetryPolicy{MaxBodyBytes: 1024}, down.URL, ok.URL)
+
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("PUT", "/", strings.NewReader("hello")))
+		if w.Code != http.StatusOK || w.Body.String() != "hello" {
+			t.Fatalf("request %d failed with %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRetry_StatusNonIdempotent(t *testing.T) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	s := retryServer(t, &RetryPolicy{MaxAttempts: 3}, unavailable.URL, unavailable.URL)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+
+	// POST requests are not retried so the backend response passes through.
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("x")))
+	if w.Code != http.StatusServiceUnavailable || w.Body.Len() != 0 {
+		t.Fatalf("expected backend response, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRetry_Budget(t *testing.T) {
+	b := &retryBudget{}
+	p := &RetryPolicy{BudgetPercent: 50, MinRetriesPerSecond: 1}
+
+	for i := 0; i < 10; i++ {
+		b.deposit()
+	}
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if b.withdraw(p) {
+			allowed++
+		}
+	}
+
+	if allowed != 15 {
+		t.Fatalf("expected 15 retries in budget, got %d", allowed)
+	}
+}
+
+func TestRetry_BudgetExhaustedPassesResponse(t *testing.T) {
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("busy"))
+	}))
+	defer busy.Close()
+
+	s := retryServer(t, &RetryPolicy{MinRetriesPerSecond: 1, BudgetPercent: 1, BackoffBase: time.Millisecond}, busy.URL, busy.URL)
+
+	// once the budget of ten retries is used up the backend response is
+	// passed through instead of a response of the load balancer.
+	for i := 0; i < 20; i++ {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusServiceUnavailable || w.Body.String() != "busy" {
+			t.Fatalf("request %d: expected backend response, got %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRetry_ClientCanceled(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	c, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(c)
+
+	var hits int32
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.AfterFunc(50*time.Millisecond, cancel)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	s := retryServer(t, &RetryPolicy{MaxAttempts: 3, BackoffBase: time.Minute}, unavailable.URL, unavailable.URL)
+
+	done := make(chan struct{})
+	w := httptest.NewRecorder()
+	go func() {
+		s.ServeHTTP(w, req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backoff did not stop when the client went away")
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("expected no retries after the client went away, got %d attempts", n)
+	}
+}
+
+func TestRetry_ChunkedBodyOverLimit(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer ok.Close()
+
+	s := retryServer(t, &RetryPolicy{MaxBodyBytes: 4}, ok.URL)
+
+	req := httptest.NewRequest("PUT", "/", strings.NewReader("hello world"))
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "hello world" {
+		t.Fatalf("expected the body to be proxied, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("PUT", "/", iotest.ErrReader(errors.New("broken")))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a failed body read, got %d", w.Code)
+	}
+}
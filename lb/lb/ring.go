@@ -0,0 +1,191 @@
+package lb
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/coldog/proxy/lb/ctx"
+)
+
+// points on the ring for the target with the highest weight.
+const ringPoints = 160
+
+func init() {
+	Use("ring_hash", NewRingHash)
+}
+
+// hashRing is a ketama style consistent hash ring. Targets are placed on
+// the ring by their ID, so adding or removing a target only remaps the keys
+// that belonged to it.
+type hashRing struct {
+	targets []*Target
+	points  []ringPoint
+}
+
+type ringPoint struct {
+	hash   uint32
+	target *Target
+}
+
+func newHashRing(targets []*Target) *hashRing {
+	r := &hashRing{targets: targets}
+
+	equal := unweighted(targets)
+	max := 1
+	for _, t := range targets {
+		if t.Weight > max {
+			max = t.Weight
+		}
+	}
+
+	for _, t := range targets {
+		weight := targetWeight(t, equal)
+		if weight <= 0 {
+			continue
+		}
+
+		n := (ringPoints*weight + max - 1) / max
+		for i := 0; i < n; i += 4 {
+			sum := md5.Sum([]byte(t.ID + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4 && i+j < n; j++ {
+				r.points = append(r.points, ringPoint{
+					hash:   binary.LittleEndian.Uint32(sum[j*4:]),
+					target: t,
+				})
+			}
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].target.ID < r.points[j].target.ID
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// get walks the ring from the hash of the key and returns the first
+// available target.
+func (r *hashRing) get(key string) *Target {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	sum := md5.Sum([]byte(key))
+	hash := binary.LittleEndian.Uint32(sum[:])
+
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+
+	for n := 0; n < len(r.points); n++ {
+		t := r.points[(i+n)%len(r.points)].target
+		if t.Available() {
+			return t
+		}
+	}
+	return nil
+}
+
+// sameTargets reports whether the ring was built from the same snapshot
+// of targets.
+func (r *hashRing) sameTargets(targets []*Target) bool {
+	if len(r.targets) != len(targets) {
+		return false
+	}
+	return len(targets) == 0 || &r.targets[0] == &targets[0]
+}
+
+// ringHash picks the target from a consistent hash ring using the
+// handler's HashKey.
+type ringHash struct {
+	ring atomic.Value
+}
+
+// NewRingHash returns a ring hash strategy, the ring is rebuilt whenever
+// the targets of the handler change.
+func NewRingHash() Strategy {
+	return &ringHash{}
+}
+
+func (s *ringHash) hashRing(h *Handler) *hashRing {
+	targets := h.targets()
+	r, _ := s.ring.Load().(*hashRing)
+	if r != nil && r.sameTargets(targets) {
+		return r
+	}
+
+	r = newHashRing(targets)
+	s.ring.Store(r)
+	return r
+}
+
+func (s *ringHash) Pick(h *Handler, c *ctx.Context) *Target {
+	return s.hashRing(h).get(hashKey(h.HashKey, c))
+}
+
+// hashKey extracts the key to hash from the request. The key is one of
+// "ip", "header:<name>", "cookie:<name>", "query:<name>" or "path:<n>" for
+// the n-th path segment starting at 0. It falls back to the client IP when
+// the request does not carry the key.
+func hashKey(key string, c *ctx.Context) string {
+	kind, name := key, ""
+	if i := strings.Index(key, ":"); i >= 0 {
+		kind, name = key[:i], key[i+1:]
+	}
+
+	r := c.Req
+	val := ""
+
+	switch kind {
+	case "header":
+		val = r.Header.Get(name)
+	case "cookie":
+		if cookie, err := r.Cookie(name); err == nil {
+			val = cookie.Value
+		}
+	case "query":
+		val = r.URL.Query().Get(name)
+	case "path":
+		n, _ := strconv.Atoi(name)
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if n >= 0 && n < len(segments) {
+			val = segments[n]
+		}
+	}
+
+	if val == "" {
+		val = c.ClientIp()
+	}
+	return val
+}
+
+func validateHashKey(key string) error {
+	kind, name := key, ""
+	if i := strings.Index(key, ":"); i >= 0 {
+		kind, name = key[:i], key[i+1:]
+	}
+
+	switch kind {
+	case "", "ip":
+		return nil
+	case "header", "cookie", "query":
+		if name == "" {
+			return errors.New("missing name in " + key)
+		}
+		return nil
+	case "path":
+		n, err := strconv.Atoi(name)
+		if err != nil || n < 0 {
+			return errors.New("invalid path segment in " + key)
+		}
+		return nil
+	}
+	return errors.New("unknown hash key " + key)
+}
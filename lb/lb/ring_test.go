@@ -0,0 +1,79 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/coldog/proxy/lb/ctx"
+)
+
+func ringHandler(n int) *Handler {
+	h := &Handler{Name: "ring", Strategy: "ring_hash", HashKey: "header:X-User"}
+	for i := 0; i < n; i++ {
+		h.Targets = append(h.Targets, &Target{ID: fmt.Sprintf("t%d", i), Weight: 1})
+	}
+	return h
+}
+
+func ringPick(h *Handler, user string) *Target {
+	r := mockReq("t", "t")
+	r.Header = http.Header{}
+	r.Header.Set("X-User", user)
+	return h.pick(ctx.New(nil, r))
+}
+
+func TestRingHash_Remapping(t *testing.T) {
+	h := ringHandler(10)
+
+	before := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		before[user] = ringPick(h, user).ID
+	}
+
+	// removing a target only moves the keys that it owned.
+	removed := h.Targets[3]
+	h.Targets = append(h.Targets[:3:3], h.Targets[4:]...)
+
+	for user, id := range before {
+		got := ringPick(h, user).ID
+		if id != removed.ID && got != id {
+			t.Fatalf("%s moved from %s to %s", user, id, got)
+		}
+		if got == removed.ID {
+			t.Fatalf("%s still on removed target", user)
+		}
+	}
+}
+
+func TestRingHash_Unavailable(t *testing.T) {
+	h := ringHandler(3)
+
+	pick := ringPick(h, "user")
+	pick.runtime().unhealthy = 1
+
+	next := ringPick(h, "user")
+	if next == nil || next == pick {
+		t.Fatal("did not fall over to the next target")
+	}
+
+	pick.runtime().unhealthy = 0
+	if ringPick(h, "user") != pick {
+		t.Fatal("did not return to the original target")
+	}
+}
+
+func TestRingHash_Weights(t *testing.T) {
+	h := ringHandler(2)
+	h.Targets[1].Weight = 3
+
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		counts[ringPick(h, fmt.Sprintf("user-%d", i)).ID]++
+	}
+
+	if counts["t1"] < 2*counts["t0"] {
+		t.Fatalf("weights not respected %v", counts)
+	}
+}
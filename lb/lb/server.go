@@ -5,154 +5,507 @@ import (
 	"github.com/coldog/proxy/lb/router"
 	"github.com/coldog/proxy/lb/stats"
 
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Middleware func(c *ctx.Context)
 
 func New(c *Config) *Server {
-	return &Server{
+	s := &Server{
 		config:     c,
-		handlers:   map[string]*Handler{},
 		middleware: map[string]Middleware{},
 		router:     router.New(),
 		lock:       &sync.RWMutex{},
-		Stats:      &stats.NoOpStatsCollector{},
+		Stats:      newStats(c),
+		Certs:      NewCertStore(certDir(c)),
+		quit:       make(chan struct{}),
+		draining:   map[*Handler]bool{},
+	}
+	s.handlers.Store(map[string]*Handler{})
+
+	if c.AccessLog != nil {
+		l, err := newAccessLogger(c.AccessLog)
+		if err != nil {
+			log.Printf("[ERROR] access log disabled %v", err)
+		} else {
+			s.accessLog = l
+		}
+	}
+
+	if c.ACME != nil {
+		m, err := newACMEManager(s, c.ACME)
+		if err != nil {
+			log.Printf("[ERROR] acme disabled %v", err)
+			return s
+		}
+
+		s.acme = m
+		s.acmeHTTP = m.HTTPHandler(nil)
+		s.Certs.Fallback = m.GetCertificate
+	}
+
+	return s
+}
+
+func certDir(c *Config) string {
+	if c.TLS == nil {
+		return ""
 	}
+	return c.TLS.CertDir
 }
 
 type Server struct {
 	Stats      stats.StatsCollector
+	Certs      *CertStore
+	acme       *autocert.Manager
+	acmeHTTP   http.Handler
 	config     *Config
-	handlers   map[string]*Handler
+	handlers   atomic.Value
 	middleware map[string]Middleware
 	router     *router.Router
 	lock       *sync.RWMutex
+	accessLog  *accessLogger
+	version    int64
+	draining   map[*Handler]bool
+	servers    []*served
+	serving    sync.WaitGroup
+	shutdown   bool
+	quit       chan struct{}
+	listeners  []net.Listener
+	addrs      []string
+	inherited  map[string]net.Listener
+	readyPipe  *os.File
 }
 
 func (s *Server) Middleware(key string, m Middleware) {
 	s.middleware[key] = m
 }
 
-func (s *Server) PutHandler(handler *Handler) {
+func (s *Server) PutHandler(handler *Handler) error {
+	err := handler.Validate()
+	if err != nil {
+		return err
+	}
+
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	s.putHandler(handler)
+	return nil
+}
+
+// putHandler publishes the handler and its routes in place of the
+// current one, which is drained and closed in the background. Must be
+// called with the write lock held.
+func (s *Server) putHandler(handler *Handler) {
 	if handler.quit == nil {
 		handler.quit = make(chan struct{})
 		handler.stats = s.Stats
 	}
 
-	s.clearHandler(handler.Name)
+	s.version++
+	handler.version = s.version
 
-	s.handlers[handler.Name] = handler
-	for _, r := range handler.Routes {
-		s.router.Add(handler.Name, r)
+	// targets of a replaced handler hand over their runtime state just
+	// like a replaced target does.
+	old := s.handlerMap()[handler.Name]
+	previous := map[string]*Target{}
+	if old != nil && old != handler {
+		for _, t := range old.targets() {
+			previous[t.ID] = t
+		}
 	}
+
 	for _, t := range handler.Targets {
 		t.stats = s.Stats
+		t.handler = handler.Name
+		if o := previous[t.ID]; o != nil && o != t {
+			t.inherit(o)
+		}
+	}
+	handler.setTargets(handler.Targets)
+
+	s.setHandler(handler.Name, handler)
+	s.router.Set(handler.Name, handler.Routes)
+	if old != nil && old != handler {
+		old.setDraining()
+		s.draining[old] = true
+		go func() {
+			drainHandler(old)
+			closeHandler(old)
+			s.drained(old)
+		}()
+	}
+
+	// the health checks of a handler that is put again are running already.
+	if handler.HealthCheck != nil && old != handler {
+		go s.healthCheck(handler)
+	}
+}
+
+// handlerMap returns the current handlers, the map must not be modified.
+func (s *Server) handlerMap() map[string]*Handler {
+	return s.handlers.Load().(map[string]*Handler)
+}
+
+// setHandler publishes a copy of the handlers where name is set to h, or
+// removed if h is nil. Must be called with the write lock held.
+func (s *Server) setHandler(name string, h *Handler) {
+	current := s.handlerMap()
+	handlers := make(map[string]*Handler, len(current)+1)
+	for k, v := range current {
+		handlers[k] = v
+	}
+	if h == nil {
+		delete(handlers, name)
+	} else {
+		handlers[name] = h
 	}
+	s.handlers.Store(handlers)
+}
+
+func newStats(c *Config) stats.StatsCollector {
+	if c.Stats != stats.STATSD {
+		return stats.New(c.Stats)
+	}
+
+	if c.StatsD == nil {
+		log.Printf("[ERROR] stats disabled, statsd is not configured")
+		return &stats.NoOpStatsCollector{}
+	}
+
+	sd, err := stats.NewStatsD(*c.StatsD)
+	if err != nil {
+		log.Printf("[ERROR] stats disabled %v", err)
+		return &stats.NoOpStatsCollector{}
+	}
+	return sd
 }
 
 func (s *Server) HasHandler(name string) bool {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	_, ok := s.handlers[name]
+	_, ok := s.handlerMap()[name]
 	return ok
 }
 
 func (s *Server) AddTarget(name string, target *Target) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if h, ok := s.handlerMap()[name]; ok {
+		s.putTarget(h, target)
+	}
+}
+
+// putTarget publishes a new list of targets with the target added or in
+// place of the target with the same ID, which hands over its runtime state
+// if the url did not change. Must be called with the write lock held.
+func (s *Server) putTarget(h *Handler, target *Target) {
 	target.stats = s.Stats
-	if h, ok := s.handlers[name]; ok {
-		h.Targets = append(h.Targets, target)
+	target.handler = h.Name
+
+	current := h.targets()
+	targets := make([]*Target, 0, len(current)+1)
+	var old *Target
+	for _, t := range current {
+		if t.ID == target.ID {
+			old = t
+			t = target
+		}
+		targets = append(targets, t)
+	}
+	if old == nil {
+		targets = append(targets, target)
+	} else {
+		target.inherit(old)
+	}
+
+	h.setTargets(targets)
+	s.touch(h)
+
+	if old != nil {
+		old.closeIdle()
 	}
 }
 
 func (s *Server) RemoveHandler(name string) {
 	s.lock.Lock()
-	h, ok := s.handlers[name]
+	h, ok := s.handlerMap()[name]
+	if ok {
+		h.setDraining()
+		s.draining[h] = true
+	}
 	s.lock.Unlock()
 
 	if !ok {
 		return
 	}
 
-	h.draining = true
-	time.Sleep(h.ShutdownWait)
+	s.drain(name, h)
+}
+
+// drain waits for the requests of the handler to finish and then removes
+// it, unless it has been replaced in the meantime. The handler must already
+// be marked as draining.
+func (s *Server) drain(name string, h *Handler) {
+	drainHandler(h)
+	defer s.drained(h)
 
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	s.clearHandler(name)
+	// the handler may have been replaced while draining.
+	if s.handlerMap()[name] != h {
+		return
+	}
+
 	s.router.Remove(name)
+	s.setHandler(name, nil)
+	closeHandler(h)
 }
 
-func (s *Server) clearHandler(name string) {
-	if h, ok := s.handlers[name]; ok {
-		h.Close()
-		delete(s.handlers, name)
+// drained stops tracking a handler once it finished draining, until then
+// a shutdown closes its connections as well.
+func (s *Server) drained(h *Handler) {
+	s.lock.Lock()
+	delete(s.draining, h)
+	s.lock.Unlock()
+}
 
-		for _, t := range h.Targets {
-			if t.tr != nil {
-				t.tr.CloseIdleConnections()
-			}
-		}
+// closeHandler closes a handler that is no longer published.
+func closeHandler(h *Handler) {
+	h.Close()
+	for _, t := range h.targets() {
+		t.closeIdle()
 	}
 }
 
+// UpdateTargetWeight replaces the target with a copy that has the new
+// weight and the same runtime state, published targets are never modified.
 func (s *Server) UpdateTargetWeight(name, targetId string, weight int) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	if h, ok := s.handlers[name]; ok {
-		for _, t := range h.Targets {
-			if targetId == t.ID {
-				t.Weight = weight
-			}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if h, ok := s.handlerMap()[name]; ok {
+		if t := h.Target(targetId); t != nil {
+			s.putTarget(h, &Target{
+				ID:       t.ID,
+				URL:      t.URL,
+				Timeout:  t.Timeout,
+				Weight:   weight,
+				Draining: t.Draining,
+			})
 		}
 	}
 }
 
 func (s *Server) RemoveTarget(name, targetId string) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	if h, ok := s.handlers[name]; ok {
-		for i, t := range h.Targets {
-			if targetId == t.ID {
-				if t.tr != nil {
-					t.tr.CloseIdleConnections()
-				}
-				h.Targets = append(h.Targets[:i], h.Targets[i+1:]...)
-				break
-			}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if h, ok := s.handlerMap()[name]; ok {
+		s.removeTarget(h, targetId)
+	}
+}
+
+func (s *Server) removeTarget(h *Handler, targetId string) bool {
+	targets := h.targets()
+	for i, t := range targets {
+		if targetId == t.ID {
+			h.setTargets(append(targets[:i:i], targets[i+1:]...))
+			s.touch(h)
+			t.closeIdle()
+			return true
 		}
 	}
+	return false
+}
+
+// touch bumps the handler version after a change. Must be called with
+// the write lock held.
+func (s *Server) touch(h *Handler) {
+	s.version++
+	h.version = s.version
 }
 
 func (s *Server) handler(key string) *Handler {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	if handler, ok := s.handlers[key]; ok {
-		return handler
+	return s.handlerMap()[key]
+}
+
+// acquire returns the handler for key with the request counted as active.
+// A draining handler does not admit requests, if it was replaced in
+// between the new one is used instead, if it is being removed there is no
+// handler. Requests admitted before are served until they are drained.
+func (s *Server) acquire(key string) *Handler {
+	for {
+		h := s.handler(key)
+		if h == nil {
+			return nil
+		}
+
+		h.active.add()
+		if !h.isDraining() {
+			return h
+		}
+		h.active.done()
+
+		if s.handler(key) == h {
+			return nil
+		}
 	}
-	return nil
 }
 
-func (s *Server) Start() {
+func (s *Server) Start() error {
+	if s.config.ACME != nil && s.acme == nil {
+		return errors.New("acme is misconfigured")
+	}
+
+	inherited, ready, err := inheritListeners()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.inherited = inherited
+	s.readyPipe = ready
+	s.lock.Unlock()
+
+	if s.config.AdminPort != 0 {
+		admin := fmt.Sprintf("%s:%d", s.config.AdminBind, s.config.AdminPort)
+		ln, err := s.listen(admin)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("[INFO] admin listening %s", admin)
+		go func() {
+			err := s.serve(&http.Server{Handler: s.Admin()}, ln, false)
+			if err != nil {
+				log.Printf("[ERROR] admin listener failed %v", err)
+			}
+		}()
+	}
+
+	var plain http.Handler = s
+
+	if c := s.config.TLS; c != nil {
+		err := s.Certs.Reload()
+		if err != nil {
+			return err
+		}
+
+		cfg, err := c.TLS(s.Certs)
+		if err != nil {
+			return err
+		}
+
+		if c.ReloadInterval > 0 {
+			go s.Certs.Watch(c.ReloadInterval, s.quit)
+		}
+
+		if s.acme != nil {
+			cfg.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		}
+
+		if c.Redirect {
+			plain = redirectHandler(c.Port)
+			if s.acme != nil {
+				plain = s.acme.HTTPHandler(plain)
+			}
+		}
+
+		listen := fmt.Sprintf("%s:%d", c.Bind, c.Port)
+		ln, err := s.listen(listen)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("[INFO] listening tls %s", listen)
+		go func() {
+			err := s.serve(&http.Server{Handler: s, TLSConfig: cfg}, ln, true)
+			if err != nil {
+				log.Printf("[ERROR] tls listener failed %v", err)
+			}
+		}()
+	}
+
 	listen := fmt.Sprintf("%s:%d", s.config.Bind, s.config.Port)
+	ln, err := s.listen(listen)
+	if err != nil {
+		return err
+	}
+
+	// http-01 challenges are answered on the plain listener, so
+	// certificates are only requested once it is bound.
+	if s.acme != nil {
+		interval := s.config.ACME.Interval
+		if interval <= 0 {
+			interval = 12 * time.Hour
+		}
+		go s.obtainCerts(interval, s.quit)
+	}
+
+	s.ready()
+
 	log.Printf("[INFO] listening %s", listen)
-	http.ListenAndServe(listen, s)
+	return s.serve(&http.Server{Handler: plain}, ln, false)
+}
+
+// explainRoute shows which route matches the url given in the query and
+// why the routes before it did not. The method query param and the headers
+// of the request are used for the match.
+func (s *Server) explainRoute(w http.ResponseWriter, r *http.Request) {
+	u, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || u.Path == "" {
+		adminError(w, http.StatusBadRequest, errors.New("url must be a valid url with a path"))
+		return
+	}
+
+	req := &http.Request{
+		Method: strings.ToUpper(r.URL.Query().Get("method")),
+		URL:    u,
+		Host:   u.Host,
+		Header: r.Header,
+	}
+	if req.Method == "" {
+		req.Method = "GET"
+	}
+	if req.Host == "" {
+		req.Host = r.Host
+	}
+
+	checks := s.router.Explain(req)
+	route := ""
+	if len(checks) > 0 && checks[len(checks)-1].Matched {
+		route = checks[len(checks)-1].Key
+	}
+
+	adminJson(w, http.StatusOK, map[string]interface{}{
+		"method": req.Method,
+		"host":   req.Host,
+		"path":   u.Path,
+		"route":  route,
+		"checks": checks,
+	})
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
+	if s.acmeHTTP != nil && strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		s.acmeHTTP.ServeHTTP(w, r)
+		return
+	}
+
 	if r.URL.Path == "/_lb/handlers" {
-		data, err := json.Marshal(s.handlers)
+		data, err := json.Marshal(s.handlerMap())
 		if err != nil {
 			log.Printf("[ERROR] failed to print json %v", err)
 			return
@@ -163,19 +516,48 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	key := s.router.Match(r)
-	handler := s.handler(key)
+	if r.URL.Path == "/_lb/route" {
+		s.explainRoute(w, r)
+		return
+	}
+
+	id := s.requestID(r)
+	w.Header().Set(ctx.RequestIDHeader, id)
+
+	var c *ctx.Context
+	if s.accessLog != nil {
+		e := &accessEntry{
+			start: time.Now(),
+			r:     r,
+			w:     &responseRecorder{ResponseWriter: w},
+			in:    &countingReader{ReadCloser: r.Body},
+		}
+		w = e.w
+		r.Body = e.in
+		defer func() {
+			e.total = time.Since(e.start)
+			e.c = c
+			s.accessLog.log(e)
+		}()
+	}
+
+	key, params := s.router.Lookup(r)
+	handler := s.acquire(key)
 
-	c := ctx.New(w, r)
+	c = ctx.New(w, r)
+	c.RequestID = id
+	c.Params = params
 
 	if handler == nil {
 		c.NoneAvailable()
 		return
 	}
+	defer handler.active.done()
+	c.Handler = handler.Name
 
 	err := handler.Process(c)
 	if err != nil {
-		log.Printf("[ERROR] error processing request %v", err)
+		requestLog(c.Req, "[ERROR] error processing request %v", err)
 	}
 
 	backend := handler.Next(c)
@@ -198,5 +580,5 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	backend.Proxy(handler, r).ServeHTTP(w, r)
+	handler.proxy(c, backend)
 }
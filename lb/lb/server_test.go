@@ -0,0 +1,281 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coldog/proxy/lb/ctx"
+	"github.com/coldog/proxy/lb/router"
+)
+
+func TestServer_RouteParams(t *testing.T) {
+	var path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+	}))
+	defer ts.Close()
+
+	s := New(DefaultConfig())
+	s.Middleware("rewrite", func(c *ctx.Context) {
+		c.Req.URL.Path = "/v2/users/" + c.Param("id")
+	})
+	s.PutHandler(&Handler{
+		Name:       "users",
+		Routes:     []*router.Route{{Path: "/users/:id", Methods: []string{"GET"}}},
+		Targets:    []*Target{{ID: "t1", URL: ts.URL, Weight: 1}},
+		Middleware: []string{"rewrite"},
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/users/42", nil))
+	if w.Code != 200 || path != "/v2/users/42" {
+		t.Fatalf("expected the rewritten path, got %d %q", w.Code, path)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("DELETE", "/users/42", nil))
+	if w.Code != 503 {
+		t.Fatalf("expected no route for DELETE, got %d", w.Code)
+	}
+}
+
+func TestServer_ExplainRoute(t *testing.T) {
+	s := New(DefaultConfig())
+	s.PutHandler(&Handler{
+		Name:    "api",
+		Routes:  []*router.Route{{Host: "api.example.com", Path: "/v1"}},
+		Targets: []*Target{{ID: "t1", URL: "http://localhost:3000", Weight: 1}},
+	})
+	s.PutHandler(&Handler{
+		Name:    "web",
+		Routes:  []*router.Route{{Path: "/"}},
+		Targets: []*Target{{ID: "t1", URL: "http://localhost:3001", Weight: 1}},
+	})
+
+	explain := func(u string) map[string]interface{} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/_lb/route?url="+url.QueryEscape(u), nil))
+		if w.Code != 200 {
+			t.Fatalf("unexpected status %d %s", w.Code, w.Body.String())
+		}
+		res := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+
+	res := explain("http://api.example.com/v1/users")
+	if res["route"] != "api" || len(res["checks"].([]interface{})) != 1 {
+		t.Fatalf("unexpected result %v", res)
+	}
+
+	res = explain("http://www.example.com/v1/users")
+	checks := res["checks"].([]interface{})
+	if res["route"] != "web" || len(checks) != 2 || checks[0].(map[string]interface{})["reason"] != "host did not match" {
+		t.Fatalf("unexpected result %v", res)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/_lb/route", nil))
+	if w.Code != 400 {
+		t.Fatalf("expected 400 without a url, got %d", w.Code)
+	}
+}
+
+func TestServer_ConcurrentReconfiguration(t *testing.T) {
+	for _, strategy := range []string{"ring_hash", "wrr"} {
+		t.Run(strategy, func(t *testing.T) {
+			testConcurrentReconfiguration(t, strategy)
+		})
+	}
+}
+
+func testConcurrentReconfiguration(t *testing.T, strategy string) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	s := New(DefaultConfig())
+	handler := func() *Handler {
+		return &Handler{
+			Name:     "api",
+			Strategy: strategy,
+			Routes:   []*router.Route{{Path: "/api"}},
+			Targets:  []*Target{{ID: "t0", URL: ts.URL, Weight: 1}},
+		}
+	}
+	s.PutHandler(handler())
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(100 * time.Microsecond):
+			}
+
+			id := fmt.Sprintf("t%d", i%3+1)
+			switch i % 5 {
+			case 0:
+				s.PutHandler(handler())
+			case 1:
+				s.AddTarget("api", &Target{ID: id, URL: ts.URL, Weight: 1})
+			case 2:
+				s.UpdateTargetWeight("api", id, 2)
+			case 3:
+				s.RemoveTarget("api", id)
+			case 4:
+				s.router.Add("other", &router.Route{Path: "/other"})
+				s.router.Remove("other")
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				w := httptest.NewRecorder()
+				s.ServeHTTP(w, httptest.NewRequest("GET", "/api", nil))
+				if w.Code != 200 {
+					t.Errorf("unexpected status %d", w.Code)
+				}
+
+				if i%20 == 0 {
+					for _, path := range []string{"/_lb/handlers", "/_lb/route?url=/api"} {
+						s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+					}
+					s.Metrics()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-done
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/api", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200 once the configuration settles, got %d", w.Code)
+	}
+}
+
+func TestServer_ReplaceTargetKeepsState(t *testing.T) {
+	s := New(DefaultConfig())
+	s.PutHandler(&Handler{
+		Name:             "api",
+		Routes:           []*router.Route{{Path: "/api"}},
+		Targets:          []*Target{{ID: "t1", URL: "http://localhost:3000", Weight: 1}},
+		OutlierDetection: &OutlierDetection{ConsecutiveGatewayFailure: 1},
+	})
+
+	h := s.handler("api")
+	old := h.Target("t1")
+	old.runtime().unhealthy = 1
+	old.runtime().inflight = 1
+	old.observe(h, nil, errors.New("refused"))
+	if !old.Ejected() {
+		t.Fatal("target not ejected")
+	}
+
+	s.UpdateTargetWeight("api", "t1", 5)
+	next := h.Target("t1")
+	if next == old || next.Weight != 5 {
+		t.Fatal("target not replaced")
+	}
+	if next.Healthy() || !next.Ejected() || next.Inflight() != 1 || next.Available() {
+		t.Fatal("runtime state was not kept")
+	}
+
+	// in flight requests of the old target finish on the shared state.
+	atomic.AddInt64(&old.runtime().inflight, -1)
+	if next.Inflight() != 0 {
+		t.Fatalf("expected no requests in flight, got %d", next.Inflight())
+	}
+
+	w := adminReq(s, "PUT", "/handlers/api/targets/t1", `{"url": "http://localhost:3000", "weight": 2}`, nil)
+	if w.Code != 200 || h.Target("t1").Healthy() {
+		t.Fatalf("runtime state was not kept by the admin api %d", w.Code)
+	}
+
+	// a target with a new url starts over.
+	w = adminReq(s, "PUT", "/handlers/api/targets/t1", `{"url": "http://localhost:3001", "weight": 2}`, nil)
+	if w.Code != 200 || !h.Target("t1").Available() {
+		t.Fatalf("expected a fresh target %d", w.Code)
+	}
+}
+
+func TestServer_ReloadKeepsTargetState(t *testing.T) {
+	s := New(DefaultConfig())
+	handler := func() *Handler {
+		return &Handler{
+			Name:   "api",
+			Routes: []*router.Route{{Path: "/api"}},
+			Targets: []*Target{
+				{ID: "t1", URL: "http://localhost:3000", Weight: 1},
+				{ID: "t2", URL: "http://localhost:3001", Weight: 1},
+			},
+		}
+	}
+
+	s.PutHandler(handler())
+	s.handler("api").Target("t1").runtime().unhealthy = 1
+	s.handler("api").Target("t2").runtime().unhealthy = 1
+
+	next := handler()
+	next.Targets[1].URL = "http://localhost:3002"
+	s.PutHandler(next)
+
+	if s.handler("api") != next || next.Target("t1").Healthy() {
+		t.Fatal("unhealthy target became healthy on reload")
+	}
+	if !next.Target("t2").Healthy() {
+		t.Fatal("target with a new url kept its state")
+	}
+}
+
+func TestServer_ReplacedHandlerServesAdmitted(t *testing.T) {
+	s := New(DefaultConfig())
+	handler := func() *Handler {
+		return &Handler{
+			Name:    "api",
+			Routes:  []*router.Route{{Path: "/api"}},
+			Targets: []*Target{{ID: "t1", URL: "http://localhost:3000", Weight: 1}},
+		}
+	}
+	s.PutHandler(handler())
+
+	// a request admitted just before the handler is replaced still gets a
+	// target, new requests go to the new handler.
+	old := s.acquire("api")
+	s.PutHandler(handler())
+
+	if old.Next(ctx.New(httptest.NewRecorder(), httptest.NewRequest("GET", "/api", nil))) == nil {
+		t.Fatal("admitted request was dropped")
+	}
+	if h := s.acquire("api"); h == old || h == nil {
+		t.Fatal("new request admitted to the replaced handler")
+	} else {
+		h.active.done()
+	}
+	old.active.done()
+
+	// a handler being removed admits no new requests.
+	h := s.handler("api")
+	h.setDraining()
+	if s.acquire("api") != nil {
+		t.Fatal("request admitted to a removed handler")
+	}
+}
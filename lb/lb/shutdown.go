@@ -0,0 +1,275 @@
+package lb
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShutdownWait = 30 * time.Second
+	newConnTimeout      = 5 * time.Second
+)
+
+// tracker counts the requests in flight for a handler and holds on to the
+// hijacked connections of raw and websocket proxies so they can be force
+// closed.
+type tracker struct {
+	lock    sync.Mutex
+	n       int
+	waiters []chan struct{}
+	conns   map[io.Closer]struct{}
+}
+
+func (t *tracker) add() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.n++
+}
+
+func (t *tracker) done() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.n--
+	if t.n == 0 {
+		for _, w := range t.waiters {
+			close(w)
+		}
+		t.waiters = nil
+	}
+}
+
+// wait blocks until no requests are in flight or the context is done.
+func (t *tracker) wait(ctx context.Context) error {
+	t.lock.Lock()
+	if t.n == 0 {
+		t.lock.Unlock()
+		return nil
+	}
+	w := make(chan struct{})
+	t.waiters = append(t.waiters, w)
+	t.lock.Unlock()
+
+	select {
+	case <-w:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *tracker) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.n
+}
+
+func (t *tracker) hold(c io.Closer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.conns == nil {
+		t.conns = map[io.Closer]struct{}{}
+	}
+	t.conns[c] = struct{}{}
+}
+
+func (t *tracker) release(c io.Closer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.conns, c)
+}
+
+func (t *tracker) closeAll() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for c := range t.conns {
+		c.Close()
+	}
+}
+
+// drainHandler waits for the requests of a draining handler to finish
+// within its shutdown wait and force closes the remaining connections.
+func drainHandler(h *Handler) {
+	wait := h.ShutdownWait
+	if wait <= 0 {
+		wait = defaultShutdownWait
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+
+	if h.active.wait(ctx) != nil {
+		log.Printf("[INFO] handler %s did not drain in %v, closing connections", h.Name, wait)
+		h.active.closeAll()
+	}
+}
+
+// served is an http.Server along with the connections it has accepted.
+// http.Server.Shutdown drops requests that are read after it was called,
+// so connections that have not sent a request yet are counted separately
+// and waited for before keep alives are turned off.
+type served struct {
+	srv   *http.Server
+	ln    net.Listener
+	conns tracker
+	fresh tracker
+	lock  sync.Mutex
+	state map[net.Conn]http.ConnState
+}
+
+func (sv *served) connState(c net.Conn, st http.ConnState) {
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+
+	prev, ok := sv.state[c]
+	if ok && prev == http.StateNew && st != http.StateNew {
+		sv.fresh.done()
+	}
+
+	switch st {
+	case http.StateNew:
+		sv.conns.add()
+		sv.fresh.add()
+		sv.state[c] = st
+	case http.StateHijacked, http.StateClosed:
+		if ok {
+			sv.conns.done()
+			delete(sv.state, c)
+		}
+	default:
+		sv.state[c] = st
+	}
+}
+
+func (s *Server) serve(srv *http.Server, ln net.Listener, tls bool) error {
+	sv := &served{srv: srv, ln: ln, state: map[net.Conn]http.ConnState{}}
+	srv.ConnState = sv.connState
+
+	s.lock.Lock()
+	if s.shutdown {
+		s.lock.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.servers = append(s.servers, sv)
+	s.serving.Add(1)
+	s.lock.Unlock()
+	defer s.serving.Done()
+
+	var err error
+	if tls {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+
+	s.lock.RLock()
+	shutdown := s.shutdown
+	s.lock.RUnlock()
+
+	if err == http.ErrServerClosed || shutdown {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops the listeners and waits for all in flight requests,
+// including websocket and raw connections, to finish. Once the context is
+// done all remaining connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	first := !s.shutdown
+	s.shutdown = true
+	servers := s.servers
+	current := s.handlerMap()
+	handlers := make([]*Handler, 0, len(current)+len(s.draining))
+	for _, h := range current {
+		handlers = append(handlers, h)
+	}
+	// replaced and removed handlers may still be serving requests.
+	for h := range s.draining {
+		if current[h.Name] != h {
+			handlers = append(handlers, h)
+		}
+	}
+	s.lock.Unlock()
+
+	if first {
+		close(s.quit)
+	}
+
+	for _, sv := range servers {
+		sv.ln.Close()
+	}
+
+	// once Serve returns every accepted connection has been tracked.
+	served := make(chan struct{})
+	go func() {
+		s.serving.Wait()
+		close(served)
+	}()
+
+	var err error
+	select {
+	case <-served:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err == nil {
+		// like http.Server, connections that do not send a request in time
+		// are treated as idle.
+		fctx, cancel := context.WithTimeout(ctx, newConnTimeout)
+		for _, sv := range servers {
+			sv.fresh.wait(fctx)
+		}
+		cancel()
+
+		for _, sv := range servers {
+			sv.srv.SetKeepAlivesEnabled(false)
+		}
+		for _, sv := range servers {
+			if err = sv.conns.wait(ctx); err != nil {
+				break
+			}
+		}
+	}
+
+	for _, h := range handlers {
+		if err != nil {
+			break
+		}
+		err = h.active.wait(ctx)
+	}
+
+	if err != nil {
+		log.Printf("[INFO] shutdown deadline reached, closing connections")
+		for _, h := range handlers {
+			h.active.closeAll()
+		}
+	}
+	for _, sv := range servers {
+		sv.srv.Close()
+	}
+
+	s.lock.Lock()
+	for _, h := range handlers {
+		h.Close()
+	}
+	s.lock.Unlock()
+
+	if !first {
+		return err
+	}
+	if c, ok := s.Stats.(io.Closer); ok {
+		c.Close()
+	}
+	if s.accessLog != nil {
+		s.accessLog.Close()
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package lb
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coldog/proxy/lb/router"
+)
+
+func startServer(t *testing.T, backend string) (*Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	c := DefaultConfig()
+	c.Bind = "127.0.0.1"
+	c.Port = port
+
+	s := New(c)
+	s.PutHandler(&Handler{
+		Name:    "test",
+		Routes:  []*router.Route{{Path: "/"}},
+		Targets: []*Target{{ID: "t1", URL: backend, Weight: 1}},
+	})
+	go s.Start()
+
+	addr := ln.Addr().String()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i > 100 {
+			t.Fatal("server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s, "http://" + addr
+}
+
+func TestShutdown_WaitsForRequests(t *testing.T) {
+	started := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer ts.Close()
+
+	s, addr := startServer(t, ts.URL)
+
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(addr + "/")
+		if err != nil {
+			resc <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		resc <- result{string(body), err}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed %v", err)
+	}
+
+	res := <-resc
+	if res.err != nil || res.body != "done" {
+		t.Fatalf("in flight request failed %q %v", res.body, res.err)
+	}
+
+	if _, err := http.Get(addr + "/"); err == nil {
+		t.Fatal("server still accepting connections")
+	}
+}
+
+func TestShutdown_Deadline(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	s, addr := startServer(t, ts.URL)
+
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(addr + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		errc <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("expected the request to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request was not closed")
+	}
+}
+
+func TestShutdown_ClosesReplacedHandlers(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	s, addr := startServer(t, ts.URL)
+
+	go func() {
+		resp, err := http.Get(addr + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	// the replaced handler still serves the request along with a raw
+	// connection when the shutdown deadline is reached.
+	old := s.handler("test")
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	old.active.hold(conn)
+
+	s.PutHandler(&Handler{
+		Name:    "test",
+		Routes:  []*router.Route{{Path: "/"}},
+		Targets: []*Target{{ID: "t1", URL: ts.URL, Weight: 1}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if !old.isClosed() {
+		t.Fatal("replaced handler was not closed")
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("raw connection of the replaced handler was not closed %v", err)
+	}
+
+	// shutting down again does not panic.
+	s.Shutdown(ctx)
+}
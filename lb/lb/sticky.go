@@ -0,0 +1,117 @@
+package lb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coldog/proxy/lb/ctx"
+)
+
+const defaultStickyCookie = "lb_affinity"
+
+// StickySession pins clients to a target with a signed cookie naming the
+// target ID. The configured strategy is used whenever the cookie is missing
+// or its target is unavailable. The secret is write only, it is left out
+// of the handler in responses and kept when an update leaves it out.
+type StickySession struct {
+	CookieName string        `json:"cookie_name"`
+	Secret     string        `json:"secret"`
+	TTL        time.Duration `json:"ttl"`
+}
+
+func (s *StickySession) Validate() error {
+	errs := ValidationErrors{}
+
+	if s.Secret == "" {
+		errs.Add("secret", "is required")
+	}
+	if s.TTL < 0 {
+		errs.Add("ttl", "must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// MarshalJSON leaves out the secret, handlers are listed on the public
+// listener and the secret would allow forging affinity cookies.
+func (s *StickySession) MarshalJSON() ([]byte, error) {
+	type config StickySession
+	return json.Marshal(struct {
+		*config
+		Secret string `json:"secret,omitempty"`
+	}{config: (*config)(s)})
+}
+
+func (s *StickySession) cookieName() string {
+	if s.CookieName == "" {
+		return defaultStickyCookie
+	}
+	return s.CookieName
+}
+
+func (s *StickySession) sign(handler, id string) string {
+	mac := hmac.New(sha256.New, []byte(s.Secret))
+	mac.Write([]byte(handler + "/" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// stickyTarget returns the target named by a valid affinity cookie if it
+// is still available.
+func (h *Handler) stickyTarget(c *ctx.Context) *Target {
+	cookie, err := c.Req.Cookie(h.StickySession.cookieName())
+	if err != nil {
+		return nil
+	}
+
+	i := strings.LastIndex(cookie.Value, ".")
+	if i < 0 {
+		return nil
+	}
+
+	id, sig := cookie.Value[:i], cookie.Value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(h.StickySession.sign(h.Name, id))) {
+		return nil
+	}
+
+	t := h.Target(id)
+	if t == nil || !t.Available() {
+		return nil
+	}
+	return t
+}
+
+// setSticky pins the client to the target, in place of a cookie set for a
+// target that was tried before.
+func (h *Handler) setSticky(c *ctx.Context, t *Target) {
+	s := h.StickySession
+
+	header := c.Writer.Header()
+	cookies := header["Set-Cookie"][:0]
+	for _, v := range header["Set-Cookie"] {
+		if !strings.HasPrefix(v, s.cookieName()+"=") {
+			cookies = append(cookies, v)
+		}
+	}
+	header["Set-Cookie"] = cookies
+
+	cookie := &http.Cookie{
+		Name:     s.cookieName(),
+		Value:    t.ID + "." + s.sign(h.Name, t.ID),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   c.Req.TLS != nil,
+	}
+	if s.TTL > 0 {
+		cookie.MaxAge = int(s.TTL / time.Second)
+	}
+
+	http.SetCookie(c.Writer, cookie)
+}
@@ -0,0 +1,167 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coldog/proxy/lb/ctx"
+	"github.com/coldog/proxy/lb/router"
+)
+
+// stickyServer serves a sticky handler in front of backends that answer
+// with their index.
+func stickyServer(t *testing.T, policy *RetryPolicy, backends ...*httptest.Server) *Server {
+	s := New(DefaultConfig())
+	h := &Handler{
+		Name:          "sticky",
+		Routes:        []*router.Route{{Path: "/"}},
+		Strategy:      "rr",
+		RetryPolicy:   policy,
+		StickySession: &StickySession{Secret: "secret"},
+	}
+	for i, b := range backends {
+		h.Targets = append(h.Targets, &Target{ID: fmt.Sprint(i), URL: b.URL, Weight: 1})
+	}
+	if err := s.PutHandler(h); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func indexServer(i int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, i)
+	}))
+}
+
+func TestSticky_Cookie(t *testing.T) {
+	b0, b1 := indexServer(0), indexServer(1)
+	defer b0.Close()
+	defer b1.Close()
+	s := stickyServer(t, nil, b0, b1)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	first := w.Body.String()
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != defaultStickyCookie {
+		t.Fatal("affinity cookie not set")
+	}
+
+	for i := 0; i < 5; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Body.String() != first {
+			t.Fatal("affinity not honored")
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Fatal("affinity cookie set again")
+		}
+	}
+
+	// a draining target falls back to the strategy.
+	s.handler("sticky").Target(first).Draining = true
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Body.String() == first {
+		t.Fatal("draining target was picked")
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || !strings.HasPrefix(cookies[0].Value, w.Body.String()+".") {
+		t.Fatalf("affinity cookie not moved to the new target %v", cookies)
+	}
+}
+
+func TestSticky_CookieAfterRetry(t *testing.T) {
+	down := indexServer(0)
+	down.Close()
+	up := indexServer(1)
+	defer up.Close()
+	s := stickyServer(t, &RetryPolicy{}, down, up)
+
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != 200 || w.Body.String() != "1" {
+			t.Fatalf("request %d failed with %d: %s", i, w.Code, w.Body.String())
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || !strings.HasPrefix(cookies[0].Value, "1.") {
+			t.Fatalf("request %d: expected a cookie for the target that served it, got %v", i, cookies)
+		}
+	}
+}
+
+func TestSticky_Forged(t *testing.T) {
+	h := sample()
+	h.StickySession = &StickySession{Secret: "secret"}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultStickyCookie, Value: "test-1.forged"})
+	if h.stickyTarget(ctx.New(nil, r)) != nil {
+		t.Fatal("forged cookie accepted")
+	}
+}
+
+func TestSticky_SecretNotServed(t *testing.T) {
+	s := New(DefaultConfig())
+	h := sample()
+	h.Strategy = "rr"
+	h.StickySession = &StickySession{Secret: "hunter2"}
+	if err := s.PutHandler(h); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/_lb/handlers", nil))
+	if w.Code != 200 || strings.Contains(w.Body.String(), "hunter2") {
+		t.Fatalf("secret served on /_lb/handlers: %s", w.Body.String())
+	}
+
+	w = adminReq(s, "GET", "/handlers/"+h.Name, "", nil)
+	if w.Code != 200 || strings.Contains(w.Body.String(), "hunter2") {
+		t.Fatalf("secret served by the admin api: %s", w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "sticky_session") {
+		t.Fatalf("sticky session missing: %s", w.Body.String())
+	}
+
+	// a changed secret still replaces the handler on reload.
+	changed := sample()
+	changed.StickySession = &StickySession{Secret: "other"}
+	if changed.fingerprint() == h.fingerprint() {
+		t.Fatal("secret not part of the fingerprint")
+	}
+}
+
+func TestSticky_AdminUpdateKeepsSecret(t *testing.T) {
+	s := New(DefaultConfig())
+	h := sample()
+	h.Strategy = "rr"
+	h.StickySession = &StickySession{Secret: "hunter2"}
+	if err := s.PutHandler(h); err != nil {
+		t.Fatal(err)
+	}
+
+	w := adminReq(s, "GET", "/handlers/"+h.Name, "", nil)
+	w = adminReq(s, "PUT", "/handlers/"+h.Name, w.Body.String(), nil)
+	if w.Code != 200 {
+		t.Fatalf("update of the served handler failed with %d: %s", w.Code, w.Body.String())
+	}
+	if secret := s.handler(h.Name).StickySession.Secret; secret != "hunter2" {
+		t.Fatalf("expected the secret to be kept, got %q", secret)
+	}
+
+	// a new handler still needs a secret.
+	w = adminReq(s, "PUT", "/handlers/new", `{"routes": [{"path": "/new"}], "sticky_session": {}}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a secret, got %d", w.Code)
+	}
+}
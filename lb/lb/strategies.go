@@ -4,89 +4,183 @@ import (
 	"github.com/coldog/proxy/lb/ctx"
 	"hash/fnv"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 )
 
-type Strategy func(h *Handler, c *ctx.Context) *Target
+// Strategy picks a target for a request. Every handler gets its own
+// instance, so a strategy may keep state across requests, but Pick is
+// called concurrently and that state must be safe for it.
+type Strategy interface {
+	Pick(h *Handler, c *ctx.Context) *Target
+}
+
+// StrategyFunc adapts a function without state to a Strategy.
+type StrategyFunc func(h *Handler, c *ctx.Context) *Target
+
+func (f StrategyFunc) Pick(h *Handler, c *ctx.Context) *Target {
+	return f(h, c)
+}
+
+var strategies = map[string]func() Strategy{
+	"wrr":           NewWRR,
+	"wrrh":          NewWRRByHealth,
+	"rr":            NewRR,
+	"rand":          stateless(RandStrategy),
+	"ip_hash":       stateless(IPHashStrategy),
+	"least_conn":    NewLeastConn,
+	"least_request": NewLeastRequest,
+}
+
+// Use registers a strategy, the constructor is called once per handler.
+func Use(name string, strategy func() Strategy) {
+	strategies[name] = strategy
+}
 
-var strategies = map[string]Strategy{
-	"wrr":     WRRStrategy,
-	"wrrh":    WRRByHealthStrategy,
-	"rr":      RRStrategy,
-	"rand":    RandStrategy,
-	"ip_hash": IPHashStrategy,
+func stateless(f StrategyFunc) func() Strategy {
+	return func() Strategy { return f }
 }
 
-func Use(name string, dispatcher Strategy) {
-	strategies[name] = dispatcher
+// counter hands out a sequence shared by concurrent requests.
+type counter struct {
+	n uint64
 }
 
-func WRRByHealthStrategy(h *Handler, c *ctx.Context) *Target {
-	if len(h.Targets) == 0 {
+// next returns the next value of the sequence modulo n.
+func (c *counter) next(n int) int {
+	return int((atomic.AddUint64(&c.n, 1) - 1) % uint64(n))
+}
+
+type rr struct {
+	counter
+}
+
+// NewRR sends to every target in turn.
+func NewRR() Strategy {
+	return &rr{}
+}
+
+func (s *rr) Pick(h *Handler, c *ctx.Context) *Target {
+	targets := h.available()
+	if len(targets) == 0 {
 		return nil
 	}
+	return targets[s.next(len(targets))]
+}
+
+// targetWeight returns the weight of a target, a target with a weight of
+// zero gets no requests unless none of the targets of the handler has a
+// weight, then they are all weighted the same.
+func targetWeight(t *Target, unweighted bool) int {
+	if unweighted {
+		return 1
+	}
+	return t.Weight
+}
 
-	for _, t := range h.Targets {
-		if t.errors == 0 {
-			t.Weight = 100
-			break
+// unweighted reports whether none of the targets has a weight.
+func unweighted(targets []*Target) bool {
+	for _, t := range targets {
+		if t.Weight > 0 {
+			return false
 		}
-
-		t.Weight = int((float64(t.errors) / float64(t.requests)) * 100)
 	}
+	return true
+}
+
+// swrr is the smooth weighted round robin of nginx. Every pick adds the
+// weight of each target to its current weight, the target with the
+// highest current weight is picked and the total weight is taken from it.
+// Targets are spread out instead of sent to in bursts.
+type swrr struct {
+	weight  func(t *Target, weight int) int
+	lock    sync.Mutex
+	current map[*Target]int
+}
 
-	return WRRStrategy(h, c)
+// NewWRR sends to the targets in proportion to their weight.
+func NewWRR() Strategy {
+	return &swrr{weight: func(t *Target, weight int) int { return weight }, current: map[*Target]int{}}
 }
 
-func WRRStrategy(h *Handler, c *ctx.Context) *Target {
-	if len(h.Targets) == 0 {
+// NewWRRByHealth is a weighted round robin where the weight of a target is
+// scaled down by the share of its requests that failed.
+func NewWRRByHealth() Strategy {
+	return &swrr{weight: healthWeight, current: map[*Target]int{}}
+}
+
+func healthWeight(t *Target, weight int) int {
+	state := t.runtime()
+	requests := atomic.LoadInt64(&state.requests)
+	if requests == 0 {
+		return weight * 100
+	}
+	ok := requests - atomic.LoadInt64(&state.errors)
+	if ok < 0 {
+		ok = 0
+	}
+	return weight * int(1+99*ok/requests)
+}
+
+func (s *swrr) Pick(h *Handler, c *ctx.Context) *Target {
+	targets := h.available()
+	if len(targets) == 0 {
 		return nil
 	}
 
-	max, gcd := nums(h)
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	for {
-		h.index = (h.index + 1) % len(h.Targets)
+	equal := unweighted(h.targets())
 
-		if h.index == 0 {
-			h.currentWeight = h.currentWeight - gcd
-			if h.currentWeight <= 0 {
-				h.currentWeight = max
-				if h.currentWeight == 0 {
-					return nil
-				}
-			}
+	var pick *Target
+	total := 0
+	for _, t := range targets {
+		w := targetWeight(t, equal)
+		if w <= 0 {
+			continue
 		}
-
-		t := h.Targets[h.index]
-		if t.Weight >= h.currentWeight {
-			return t
+		w = s.weight(t, w)
+		total += w
+		s.current[t] += w
+		if pick == nil || s.current[t] > s.current[pick] {
+			pick = t
 		}
 	}
+	if pick == nil {
+		return nil
+	}
+	s.current[pick] -= total
 
-	return nil
+	// forget targets that are gone or unavailable.
+	if len(s.current) > len(targets) {
+		current := make(map[*Target]int, len(targets))
+		for _, t := range targets {
+			current[t] = s.current[t]
+		}
+		s.current = current
+	}
+	return pick
 }
 
 func RandStrategy(h *Handler, c *ctx.Context) *Target {
-	pick := rand.Intn(len(h.Targets) - 1)
-	h.index = pick
-	return h.Targets[pick]
-}
-
-func RRStrategy(h *Handler, c *ctx.Context) *Target {
-	this := h.index + 1
-	if this > len(h.Targets)-1 {
-		this = 0
+	targets := h.available()
+	if len(targets) == 0 {
+		return nil
 	}
-
-	h.index = this
-	return h.Targets[this]
+	return targets[rand.Intn(len(targets))]
 }
 
 func IPHashStrategy(handler *Handler, c *ctx.Context) *Target {
+	targets := handler.available()
+	if len(targets) == 0 {
+		return nil
+	}
+
 	ip := c.ClientIp()
 
 	if ip == "" || ip == "unknown" {
-		return handler.Targets[rand.Intn(len(handler.Targets)-1)]
+		return targets[rand.Intn(len(targets))]
 	}
 
 	h := fnv.New64a()
@@ -94,35 +188,77 @@ func IPHashStrategy(handler *Handler, c *ctx.Context) *Target {
 	key := h.Sum64()
 
 	var b, j int64
-	for j < int64(len(handler.Targets)-1) {
+	for j < int64(len(targets)-1) {
 		b = j
 		key = key*2862933555777941757 + 1
 		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
 	}
 
-	handler.index = int(b)
-	return handler.Targets[int(b)]
+	return targets[int(b)]
+}
+
+type leastConn struct {
+	counter
 }
 
-func nums(h *Handler) (max, gcd int) {
-	for _, t := range h.Targets {
-		if t.Weight > max {
-			max = t.Weight
+// NewLeastConn picks the target with the fewest requests in flight, ties
+// are broken round robin.
+func NewLeastConn() Strategy {
+	return &leastConn{}
+}
+
+func (s *leastConn) Pick(h *Handler, c *ctx.Context) *Target {
+	targets := h.available()
+	if len(targets) == 0 {
+		return nil
+	}
+
+	start := s.next(len(targets))
+
+	var pick *Target
+	for i := range targets {
+		t := targets[(start+i)%len(targets)]
+		if pick == nil || t.Inflight() < pick.Inflight() {
+			pick = t
 		}
 	}
+	return pick
+}
+
+type leastRequest struct {
+	counter
+}
+
+// NewLeastRequest picks the target with the highest weight relative to
+// the requests it has in flight.
+func NewLeastRequest() Strategy {
+	return &leastRequest{}
+}
+
+func (s *leastRequest) Pick(h *Handler, c *ctx.Context) *Target {
+	targets := h.available()
+	if len(targets) == 0 {
+		return nil
+	}
 
-	SELECTION:
-	for i := 1; i < max; i++ {
-		for _, t := range h.Targets {
-			if t.Weight % i != 0 {
-				continue SELECTION
-			}
+	start := s.next(len(targets))
+	equal := unweighted(h.targets())
+
+	var pick *Target
+	var best float64
+	for i := range targets {
+		t := targets[(start+i)%len(targets)]
+
+		weight := targetWeight(t, equal)
+		if weight <= 0 {
+			continue
 		}
 
-		if i > gcd {
-			gcd = i
+		score := float64(weight) / float64(t.Inflight()+1)
+		if pick == nil || score > best {
+			pick = t
+			best = score
 		}
 	}
-
-	return
+	return pick
 }
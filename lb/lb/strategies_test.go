@@ -6,7 +6,12 @@ import (
 	"net/url"
 	"net/http"
 	"github.com/coldog/proxy/lb/ctx"
+	"github.com/coldog/proxy/lb/stats"
 	"fmt"
+	"net/http/httptest"
+	"time"
+	"sync"
+	"math"
 )
 
 func sample() *Handler {
@@ -44,19 +49,170 @@ func mockReq(host, path string) *http.Request {
 	}
 }
 
-func TestStrategies_Divisor(t *testing.T) {
+func TestStrategies_WRR(t *testing.T) {
 	h := sample()
-	max, gcd := nums(h)
-	if gcd != 4 && max != 12 {
-		t.Fail()
+
+	for i := 0; i < 50; i++ {
+		if NewWRR().Pick(h, ctx.New(nil, mockReq("t", "t"))) == nil {
+			t.Fatal("no target picked")
+		}
 	}
 }
 
-func TestStrategies_WRR(t *testing.T) {
+func TestStrategies_SmoothWRR(t *testing.T) {
+	h := &Handler{Targets: []*Target{{ID: "a", Weight: 5}, {ID: "b", Weight: 1}, {ID: "c", Weight: 1}}}
+
+	s := NewWRR()
+	picks := ""
+	for i := 0; i < 14; i++ {
+		picks += s.Pick(h, ctx.New(nil, mockReq("t", "t"))).ID
+	}
+	if picks != "aabacaaaabacaa" {
+		t.Fatalf("expected smooth picks, got %s", picks)
+	}
+}
+
+// parallelPicks picks n targets from g goroutines at once and counts the
+// picks per target.
+func parallelPicks(h *Handler, g, n int) map[string]int {
+	lock := sync.Mutex{}
+	counts := map[string]int{}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < g; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := map[string]int{}
+			for j := 0; j < n/g; j++ {
+				local[h.pick(ctx.New(nil, mockReq("t", "t"))).ID]++
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			for id, c := range local {
+				counts[id] += c
+			}
+		}()
+	}
+	wg.Wait()
+	return counts
+}
+
+func TestStrategies_ParallelFairness(t *testing.T) {
+	for _, c := range []struct {
+		strategy  string
+		tolerance float64
+	}{
+		{"rr", 0},
+		{"wrr", 0},
+		{"wrrh", 0},
+		{"least_conn", 0},
+		{"rand", 0.1},
+	} {
+		h := &Handler{
+			Strategy: c.strategy,
+			Targets:  []*Target{{ID: "a", Weight: 1}, {ID: "b", Weight: 2}, {ID: "c", Weight: 3}},
+		}
+		want := map[string]float64{"a": 1000, "b": 2000, "c": 3000}
+		if c.strategy == "rr" || c.strategy == "least_conn" || c.strategy == "rand" {
+			want = map[string]float64{"a": 2000, "b": 2000, "c": 2000}
+		}
+
+		counts := parallelPicks(h, 8, 6000)
+		for id, n := range want {
+			if math.Abs(float64(counts[id])-n) > n*c.tolerance {
+				t.Errorf("%s: expected %v picks of %s, got %v", c.strategy, n, id, counts)
+			}
+		}
+	}
+}
+
+func TestStrategies_LeastConn(t *testing.T) {
 	h := sample()
+	h.Targets[0].runtime().inflight = 2
+	h.Targets[1].runtime().inflight = 1
 
-	for i := 0; i < 50; i++ {
-		t := WRRStrategy(h, ctx.New(nil, mockReq("t", "t")))
-		fmt.Println(t.ID)
+	s := NewLeastConn()
+	for i := 0; i < 10; i++ {
+		if s.Pick(h, ctx.New(nil, mockReq("t", "t"))) != h.Targets[1] {
+			t.Fatal("did not pick the least loaded target")
+		}
+	}
+}
+
+func TestStrategies_LeastRequest(t *testing.T) {
+	h := sample()
+
+	// test-2 has double the weight so it takes up to double the load.
+	h.Targets[0].runtime().inflight = 1
+	h.Targets[1].runtime().inflight = 2
+	s := NewLeastRequest()
+	if s.Pick(h, ctx.New(nil, mockReq("t", "t"))) != h.Targets[1] {
+		t.Fatal("did not respect weights")
+	}
+
+	h.Targets[1].runtime().inflight = 4
+	if s.Pick(h, ctx.New(nil, mockReq("t", "t"))) != h.Targets[0] {
+		t.Fatal("did not pick the least loaded target")
+	}
+}
+
+func TestStrategies_ZeroWeight(t *testing.T) {
+	for _, strategy := range []string{"wrr", "wrrh", "least_request"} {
+		h := &Handler{
+			Strategy: strategy,
+			Targets:  []*Target{{ID: "a", Weight: 1}, {ID: "b", Weight: 0}},
+		}
+		if counts := parallelPicks(h, 4, 100); counts["b"] != 0 {
+			t.Errorf("%s: target without weight picked %v", strategy, counts)
+		}
+
+		// without any weights the targets are picked alike.
+		h = &Handler{
+			Strategy: strategy,
+			Targets:  []*Target{{ID: "a"}, {ID: "b"}},
+		}
+		if counts := parallelPicks(h, 4, 100); counts["a"] == 0 || counts["b"] == 0 {
+			t.Errorf("%s: expected both targets picked, got %v", strategy, counts)
+		}
+	}
+
+	h := ringHandler(2)
+	h.Targets[1].Weight = 0
+	for i := 0; i < 100; i++ {
+		if ringPick(h, fmt.Sprint(i)) != h.Targets[0] {
+			t.Fatal("ring_hash: target without weight picked")
+		}
+	}
+}
+
+func TestTarget_Inflight(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+
+	h := sample()
+	target := &Target{ID: "t1", URL: ts.URL, stats: &stats.NoOpStatsCollector{}}
+
+	done := make(chan struct{})
+	go func() {
+		target.ServeHTTP(h, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		close(done)
+	}()
+
+	for i := 0; target.Inflight() != 1; i++ {
+		if i > 100 {
+			t.Fatal("request not tracked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	<-done
+	if target.Inflight() != 0 {
+		t.Fatal("request not released")
 	}
 }
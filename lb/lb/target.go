@@ -1,90 +1,264 @@
 package lb
 
 import (
+	"github.com/coldog/proxy/lb/ctx"
 	"github.com/coldog/proxy/lb/stats"
 
 	"golang.org/x/net/websocket"
 
+	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
+	"encoding/json"
 )
 
 type Target struct {
-	ID             string
-	URL            string
-	Timeout        int
-	Weight         int
-
-	requests       int64
-	errors         int64
-
+	ID             string `json:"id"`
+	URL            string `json:"url"`
+	Timeout        int    `json:"timeout"`
+	Weight         int    `json:"weight"`
+	Draining       bool   `json:"draining"`
+
+	state          *targetState
+	stateOnce      sync.Once
+
+	proxyOnce      sync.Once
+	proxyErr       error
+	proxyReady     int32
 	proxy          http.Handler
 	rawProxy       http.Handler
 	wsProxy        http.Handler
 	url            *url.URL
 	tr             *http.Transport
 	stats          stats.StatsCollector
+	handler        string
 }
 
-func (b *Target) Proxy(h *Handler, r *http.Request) http.Handler {
-	if b.url == nil {
-		u, err := url.Parse(b.URL)
-		if err != nil {
-			return nil
+// targetState is the runtime state of a target. A target that replaces
+// another one with the same url shares it, so changing the configuration
+// of a target keeps its health, ejection, breaker and in flight requests.
+type targetState struct {
+	requests int64
+	errors   int64
+	inflight int64
+
+	unhealthy   int32
+	checkLock   sync.Mutex
+	checkPasses int
+	checkFails  int
+	outlier     outlier
+	latency     ewma
+	breaker     breaker
+}
+
+// runtime returns the runtime state of the target, created on first use
+// unless it was inherited.
+func (b *Target) runtime() *targetState {
+	b.stateOnce.Do(func() {
+		if b.state == nil {
+			b.state = &targetState{}
 		}
+	})
+	return b.state
+}
+
+// inherit shares the runtime state of the target it replaces if both point
+// to the same url. Must be called before the target is published.
+func (b *Target) inherit(old *Target) {
+	if old.URL == b.URL {
+		b.state = old.runtime()
+	}
+}
+
+// MarshalJSON adds the runtime state of the target to the configuration.
+func (b *Target) MarshalJSON() ([]byte, error) {
+	type config Target
+	return json.Marshal(struct {
+		*config
+		Healthy  bool  `json:"healthy"`
+		Ejected  bool  `json:"ejected"`
+		Inflight int64 `json:"inflight"`
+		Latency  int64   `json:"latency"`
+		P50      int64   `json:"latency_p50"`
+		P99      int64   `json:"latency_p99"`
+		Rate     float64 `json:"request_rate"`
+		Open     bool    `json:"circuit_open"`
+	}{
+		config:   (*config)(b),
+		Healthy:  b.Healthy(),
+		Ejected:  b.Ejected(),
+		Inflight: b.Inflight(),
+		Latency:  int64(b.runtime().latency.get()),
+		P50:      int64(b.LatencyPercentile(50)),
+		P99:      int64(b.LatencyPercentile(99)),
+		Rate:     b.RequestRate(stats.Window),
+		Open:     b.runtime().breaker.open(time.Now()),
+	})
+}
+
+func latencyKey(handler, id string) string {
+	return stats.Key("lb_upstream_duration_seconds", "handler", handler, "target", id)
+}
+
+// LatencyPercentile returns the p-th percentile, 0 to 100, of the upstream
+// latency of the target over the last stats.Window.
+func (b *Target) LatencyPercentile(p float64) time.Duration {
+	if b.stats == nil {
+		return 0
+	}
+	return b.stats.GetPercentile(latencyKey(b.handler, b.ID), p)
+}
 
-		b.url = u
+// RequestRate returns the upstream requests per second of the target over
+// the window.
+func (b *Target) RequestRate(window time.Duration) float64 {
+	if b.stats == nil {
+		return 0
 	}
+	return b.stats.GetRate(latencyKey(b.handler, b.ID), window)
+}
 
-	if b.tr == nil {
-		b.tr = &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout:   h.DialTimeout,
-				KeepAlive: h.KeepAliveTimeout,
-				Cancel:    h.quit,
-			}).Dial,
-			DisableKeepAlives:     h.DisableKeepAlives,
-			ResponseHeaderTimeout: h.ResponseHeaderTimeout,
-			ExpectContinueTimeout: h.DialTimeout,
-			MaxIdleConnsPerHost:   h.MaxConn,
-			DisableCompression:    h.DisableCompression,
+// Inflight returns the number of requests and connections currently being
+// proxied to the target.
+func (b *Target) Inflight() int64 {
+	return atomic.LoadInt64(&b.runtime().inflight)
+}
+
+// ServeHTTP proxies the request to the target and tracks it as in flight
+// until the response body, websocket or raw connection is done.
+func (b *Target) ServeHTTP(h *Handler, w http.ResponseWriter, r *http.Request) {
+	state := b.runtime()
+	atomic.AddInt64(&state.inflight, 1)
+	defer atomic.AddInt64(&state.inflight, -1)
+
+	if c := ctx.From(r); c != nil {
+		c.Target = b.ID
+		if h.StickySession != nil && h.stickyTarget(c) != b {
+			h.setSticky(c, b)
 		}
 	}
 
+	p := b.Proxy(h, r)
+	if p == nil {
+		http.Error(w, "error contacting backend server", http.StatusBadGateway)
+		return
+	}
+	p.ServeHTTP(w, r)
+}
+
+func (b *Target) Validate() error {
+	errs := ValidationErrors{}
+
+	if b.ID == "" {
+		errs.Add("id", "is required")
+	}
+
+	u, err := url.Parse(b.URL)
+	if b.URL == "" {
+		errs.Add("url", "is required")
+	} else if err != nil {
+		errs.Add("url", err.Error())
+	} else if u.Scheme == "" || u.Host == "" {
+		errs.Add("url", "must be an absolute url")
+	}
+
+	if b.Weight < 0 {
+		errs.Add("weight", "must not be negative")
+	}
+
+	if b.Timeout < 0 {
+		errs.Add("timeout", "must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (b *Target) Proxy(h *Handler, r *http.Request) http.Handler {
+	b.proxyOnce.Do(func() {
+		b.proxyErr = b.setupProxy(h)
+	})
+	if b.proxyErr != nil {
+		log.Printf("[ERROR] proxy for %s. %s", b.ID, b.proxyErr)
+		return nil
+	}
+
 	if h.RawProxy {
-		if b.rawProxy == nil {
-			b.rawProxy = newRawProxy(b.url)
-		}
 		return b.rawProxy
+	}
+	if r.Header.Get("Upgrade") == "websocket" {
+		return b.wsProxy
+	}
+	return b.proxy
+}
 
+// setupProxy creates the transport and proxies of the target the first
+// time it is used.
+func (b *Target) setupProxy(h *Handler) error {
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		return err
+	}
+	b.url = u
+
+	cfg, err := h.upstreamTLS()
+	if err != nil {
+		return fmt.Errorf("upstream tls: %v", err)
+	}
+
+	b.tr = &http.Transport{
+		TLSClientConfig: cfg,
+		Dial: (&net.Dialer{
+			Timeout:   h.DialTimeout,
+			KeepAlive: h.KeepAliveTimeout,
+			Cancel:    h.quit,
+		}).Dial,
+		DisableKeepAlives:     h.DisableKeepAlives,
+		ResponseHeaderTimeout: h.ResponseHeaderTimeout,
+		ExpectContinueTimeout: h.DialTimeout,
+		MaxIdleConnsPerHost:   h.MaxConn,
+		DisableCompression:    h.DisableCompression,
+	}
+
+	if h.RawProxy {
+		b.rawProxy = newRawProxy(b.url, cfg, &h.active)
 	} else {
-		if r.Header.Get("Upgrade") == "websocket" {
-			if b.wsProxy == nil {
-				b.wsProxy = newWSProxy(b.url)
-			}
-			return b.wsProxy
-		} else {
-			if b.proxy == nil {
-				b.proxy = newHTTPProxyWithTripper(b, time.Duration(0))
-			}
-			return b.proxy
-		}
+		b.wsProxy = newWSProxy(b.url, cfg, &h.active)
+		b.proxy = newHTTPProxyWithTripper(b, h, time.Duration(0))
 	}
+
+	atomic.StoreInt32(&b.proxyReady, 1)
+	return nil
 }
 
-func newHTTPProxyWithTripper(t *Target, flush time.Duration) http.Handler {
+// closeIdle closes the idle upstream connections if the target was used.
+func (b *Target) closeIdle() {
+	if atomic.LoadInt32(&b.proxyReady) == 1 {
+		b.tr.CloseIdleConnections()
+	}
+}
+
+func newHTTPProxyWithTripper(t *Target, h *Handler, flush time.Duration) http.Handler {
 	rp := httputil.NewSingleHostReverseProxy(t.url)
 	rp.FlushInterval = flush
+	rp.ModifyResponse = proxyModifyResponse
+	rp.ErrorHandler = proxyErrorHandler
 	rp.Transport = &meteredRoundTripper{
 		id: t.ID,
 		tr: t.tr,
 		stat: t.stats,
 		t: t,
+		h: h,
 	}
 	return rp
 }
@@ -94,25 +268,42 @@ type meteredRoundTripper struct {
 	tr http.RoundTripper
 	stat stats.StatsCollector
 	t *Target
+	h *Handler
 }
 
 func (m *meteredRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
 
 	t1 := time.Now()
 	resp, err := m.tr.RoundTrip(r)
+	latency := time.Since(t1)
 
-	m.stat.SetTime(m.id, t1)
-	m.stat.SetIncrement(m.id + "." + statusCodeName(resp), 1)
+	if c := ctx.From(r); c != nil {
+		c.UpstreamTime += latency
+		c.UpstreamStatus = 0
+		if resp != nil {
+			c.UpstreamStatus = resp.StatusCode
+		}
+	}
+
+	m.stat.SetTime(latencyKey(m.h.Name, m.id), t1)
+	m.t.observeLatency(m.h, latency)
+	m.stat.SetIncrement(stats.Key("lb_upstream_responses_total", "handler", m.h.Name, "target", m.id, "code", statusCodeName(resp)), 1)
 
-	m.t.requests += 1
+	state := m.t.runtime()
+	atomic.AddInt64(&state.requests, 1)
 	if err != nil || resp.StatusCode >= 500 {
-		m.t.errors += 1
+		atomic.AddInt64(&state.errors, 1)
+	}
+
+	if !clientCanceled(r, err) {
+		m.t.observe(m.h, resp, err)
+		m.t.recordBreaker(m.h, resp, err)
 	}
 
 	return resp, err
 }
 
-func newRawProxy(t *url.URL) http.Handler {
+func newRawProxy(t *url.URL, cfg *tls.Config, active *tracker) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		hj, ok := w.(http.Hijacker)
@@ -123,23 +314,32 @@ func newRawProxy(t *url.URL) http.Handler {
 
 		in, _, err := hj.Hijack()
 		if err != nil {
-			log.Printf("[ERROR] Hijack error for %s. %s", r.URL, err)
+			requestLog(r, "[ERROR] Hijack error for %s. %s", r.URL, err)
 			http.Error(w, "hijack error", http.StatusInternalServerError)
 			return
 		}
 		defer in.Close()
+		active.hold(in)
+		defer active.release(in)
 
-		out, err := net.Dial("tcp", t.Host)
+		var out net.Conn
+		if secure(t) {
+			out, err = tls.Dial("tcp", hostPort(t), cfg)
+		} else {
+			out, err = net.Dial("tcp", hostPort(t))
+		}
 		if err != nil {
-			log.Printf("[ERROR] WS error for %s. %s", r.URL, err)
+			requestLog(r, "[ERROR] WS error for %s. %s", r.URL, err)
 			http.Error(w, "error contacting backend server", http.StatusInternalServerError)
 			return
 		}
 		defer out.Close()
+		active.hold(out)
+		defer active.release(out)
 
 		err = r.Write(out)
 		if err != nil {
-			log.Printf("[ERROR] Error copying request for %s. %s", r.URL, err)
+			requestLog(r, "[ERROR] Error copying request for %s. %s", r.URL, err)
 			http.Error(w, "error copying request", http.StatusInternalServerError)
 			return
 		}
@@ -154,23 +354,41 @@ func newRawProxy(t *url.URL) http.Handler {
 		go cp(in, out)
 		err = <-errc
 		if err != nil && err != io.EOF {
-			log.Printf("[INFO] WS error for %s. %s", r.URL, err)
+			requestLog(r, "[INFO] WS error for %s. %s", r.URL, err)
 		}
 	})
 }
 
-func newWSProxy(t *url.URL) http.Handler {
+func newWSProxy(t *url.URL, cfg *tls.Config, active *tracker) http.Handler {
 	return websocket.Handler(func(in *websocket.Conn) {
 		defer in.Close()
+		active.hold(in)
+		defer active.release(in)
 
 		r := in.Request()
-		targetURL := "ws://" + t.Host + r.RequestURI
-		out, err := websocket.Dial(targetURL, "", r.Header.Get("Origin"))
+		scheme := "ws://"
+		if secure(t) {
+			scheme = "wss://"
+		}
+
+		config, err := websocket.NewConfig(scheme+t.Host+r.RequestURI, r.Header.Get("Origin"))
+		if err != nil {
+			requestLog(r, "[INFO] WS error for %s. %s", r.URL, err)
+			return
+		}
+		config.TlsConfig = cfg
+		if id := r.Header.Get(ctx.RequestIDHeader); id != "" {
+			config.Header = http.Header{ctx.RequestIDHeader: {id}}
+		}
+
+		out, err := websocket.DialConfig(config)
 		if err != nil {
-			log.Printf("[INFO] WS error for %s. %s", r.URL, err)
+			requestLog(r, "[INFO] WS error for %s. %s", r.URL, err)
 			return
 		}
 		defer out.Close()
+		active.hold(out)
+		defer active.release(out)
 
 		errc := make(chan error, 2)
 		cp := func(dst io.Writer, src io.Reader) {
@@ -182,7 +400,7 @@ func newWSProxy(t *url.URL) http.Handler {
 		go cp(in, out)
 		err = <-errc
 		if err != nil && err != io.EOF {
-			log.Printf("[INFO] WS error for %s. %s", r.URL, err)
+			requestLog(r, "[INFO] WS error for %s. %s", r.URL, err)
 		}
 	})
 }
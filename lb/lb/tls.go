@@ -0,0 +1,283 @@
+package lb
+
+import (
+	"golang.org/x/crypto/acme"
+
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TLSConfig struct {
+	Bind           string        `json:"bind"`
+	Port           int           `json:"port"`
+	CertDir        string        `json:"cert_dir"`
+	MinVersion     string        `json:"min_version"`
+	CipherSuites   []string      `json:"cipher_suites"`
+	Redirect       bool          `json:"redirect"`
+	ReloadInterval time.Duration `json:"reload_interval"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLS builds the tls configuration for the https listener, certificates
+// are picked from the store by SNI.
+func (c *TLSConfig) TLS(store *CertStore) (*tls.Config, error) {
+	cfg := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, errors.New("unknown tls version " + c.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	if len(c.CipherSuites) > 0 {
+		suites := map[string]uint16{}
+		for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[s.Name] = s.ID
+		}
+
+		for _, name := range c.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, errors.New("unknown cipher suite " + name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+
+	return cfg, nil
+}
+
+// CertStore holds the certificates served by the https listener. It loads
+// every <name>.crt or <name>.pem with a matching <name>.key from a
+// directory and indexes them by the names in the certificate.
+type CertStore struct {
+	Dir string
+
+	// Fallback is asked for a certificate when there is no certificate
+	// in the directory for the exact name.
+	Fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	lock  sync.RWMutex
+	certs map[string]*tls.Certificate
+	def   *tls.Certificate
+	stamp string
+}
+
+func NewCertStore(dir string) *CertStore {
+	return &CertStore{
+		Dir:   dir,
+		certs: map[string]*tls.Certificate{},
+	}
+}
+
+// Reload reads all certificates from the directory, the current
+// certificates are kept if any of them fails to load.
+func (cs *CertStore) Reload() error {
+	stamp, pairs, err := cs.scan()
+	if err != nil {
+		return err
+	}
+
+	certs := map[string]*tls.Certificate{}
+	var def *tls.Certificate
+
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return fmt.Errorf("%s: %v", pair[0], err)
+		}
+
+		err = indexCert(certs, &cert)
+		if err != nil {
+			return fmt.Errorf("%s: %v", pair[0], err)
+		}
+
+		if def == nil {
+			def = &cert
+		}
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.certs = certs
+	cs.def = def
+	cs.stamp = stamp
+	return nil
+}
+
+// scan lists the key pairs in the directory with a stamp of their
+// modification times to detect changes.
+func (cs *CertStore) scan() (string, [][2]string, error) {
+	if cs.Dir == "" {
+		return "", nil, nil
+	}
+
+	files, err := ioutil.ReadDir(cs.Dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	stamp := ""
+	pairs := [][2]string{}
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		if ext != ".crt" && ext != ".pem" {
+			continue
+		}
+
+		cert := filepath.Join(cs.Dir, f.Name())
+		key := strings.TrimSuffix(cert, ext) + ".key"
+
+		info, err := os.Stat(key)
+		if err != nil {
+			continue
+		}
+
+		pairs = append(pairs, [2]string{cert, key})
+		stamp += fmt.Sprintf("%s:%d:%d;", f.Name(), f.ModTime().UnixNano(), info.ModTime().UnixNano())
+	}
+
+	return stamp, pairs, nil
+}
+
+// Watch polls the directory and reloads the certificates when they change
+// until quit is closed.
+func (cs *CertStore) Watch(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		stamp, _, err := cs.scan()
+		if err != nil {
+			log.Printf("[ERROR] certs: %v", err)
+			continue
+		}
+
+		cs.lock.RLock()
+		changed := stamp != cs.stamp
+		cs.lock.RUnlock()
+
+		if changed {
+			log.Printf("[INFO] certs: reloading %s", cs.Dir)
+			err = cs.Reload()
+			if err != nil {
+				log.Printf("[ERROR] certs: reload failed %v", err)
+			}
+		}
+	}
+}
+
+func (cs *CertStore) Len() int {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	return len(cs.certs)
+}
+
+// GetCertificate picks the certificate for the exact name, then asks the
+// fallback, then looks for a wildcard certificate and finally returns the
+// first certificate of the directory. The fallback may block on issuing a
+// certificate so it is called without holding the lock.
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	cs.lock.RLock()
+	exact := cs.certs[name]
+	var wildcard *tls.Certificate
+	if i := strings.Index(name, "."); i > 0 {
+		wildcard = cs.certs["*"+name[i:]]
+	}
+	def := cs.def
+	fallback := cs.Fallback
+	cs.lock.RUnlock()
+
+	if exact != nil && !wantsChallenge(hello) {
+		return exact, nil
+	}
+
+	if fallback != nil {
+		cert, err := fallback(hello)
+		if err == nil || wantsChallenge(hello) {
+			return cert, err
+		}
+	}
+
+	if wildcard != nil {
+		return wildcard, nil
+	}
+
+	if def != nil {
+		return def, nil
+	}
+	return nil, errors.New("no certificate for " + hello.ServerName)
+}
+
+// wantsChallenge checks for a tls-alpn-01 challenge handshake.
+func wantsChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+func indexCert(certs map[string]*tls.Certificate, cert *tls.Certificate) error {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+
+	for _, n := range names {
+		certs[strings.ToLower(n)] = cert
+	}
+	return nil
+}
+
+// redirectHandler sends plain http requests to the https listener.
+func redirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, fmt.Sprint(port))
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
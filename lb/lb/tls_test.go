@@ -0,0 +1,157 @@
+package lb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCert(t *testing.T, dir, name string, hosts ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func TestCertStore_SNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeCert(t, dir, "a", "a.example.com")
+	writeCert(t, dir, "wild", "*.example.org")
+
+	cs := NewCertStore(dir)
+	if err := cs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	for host, expect := range map[string]string{
+		"a.example.com":   "a.example.com",
+		"x.example.org":   "*.example.org",
+		"unknown.example": "a.example.com",
+	} {
+		cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Leaf.DNSNames[0] != expect {
+			t.Fatalf("%s got certificate for %s", host, cert.Leaf.DNSNames[0])
+		}
+	}
+
+	// certificates added to the directory show up after a reload.
+	writeCert(t, dir, "b", "b.example.com")
+	stamp, _, _ := cs.scan()
+	if stamp == cs.stamp {
+		t.Fatal("change not detected")
+	}
+	cs.Reload()
+
+	cert, _ := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"})
+	if cert.Leaf.DNSNames[0] != "b.example.com" {
+		t.Fatal("certificate not reloaded")
+	}
+}
+
+func TestCertStore_FallbackUnlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeCert(t, dir, "a", "a.example.com")
+
+	cs := NewCertStore(dir)
+	if err := cs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	issuing := make(chan struct{})
+	release := make(chan struct{})
+	cs.Fallback = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		close(issuing)
+		<-release
+		return nil, errors.New("not issued")
+	}
+	defer close(release)
+
+	go cs.GetCertificate(&tls.ClientHelloInfo{ServerName: "new.example.com"})
+	<-issuing
+
+	// a reload and other handshakes go on while a certificate is issued.
+	done := make(chan struct{})
+	go func() {
+		cs.Reload()
+		cs.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked behind the fallback")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	c := &TLSConfig{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}
+	cfg, err := c.TLS(NewCertStore(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 || len(cfg.CipherSuites) != 1 {
+		t.Fatal("tls config not applied")
+	}
+
+	c.CipherSuites = []string{"nope"}
+	if _, err := c.TLS(NewCertStore("")); err == nil {
+		t.Fatal("expected unknown cipher error")
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	w := httptest.NewRecorder()
+	redirectHandler(8443).ServeHTTP(w, httptest.NewRequest("GET", "http://example.com:8080/a?b=c", nil))
+
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://example.com:8443/a?b=c" {
+		t.Fatalf("unexpected redirect %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,183 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Listening sockets are handed to an upgraded process as extra files. The
+// addresses are passed in order starting at fd 3, followed by a pipe the
+// new process writes to once it is listening.
+const (
+	ListenersEnv = "LB_LISTENERS"
+	ReadyEnv     = "LB_READY_FD"
+)
+
+// inheritListeners returns the listeners passed down by a parent process
+// keyed by address, and the pipe to signal readiness on.
+func inheritListeners() (map[string]net.Listener, *os.File, error) {
+	addrs := os.Getenv(ListenersEnv)
+	ready := os.Getenv(ReadyEnv)
+	os.Unsetenv(ListenersEnv)
+	os.Unsetenv(ReadyEnv)
+
+	listeners := map[string]net.Listener{}
+	if addrs == "" {
+		return listeners, nil, nil
+	}
+
+	for i, addr := range strings.Split(addrs, ",") {
+		f := os.NewFile(uintptr(3+i), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("inherit %s: %v", addr, err)
+		}
+		listeners[addr] = ln
+	}
+
+	fd, err := strconv.Atoi(ready)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s: %q", ReadyEnv, ready)
+	}
+	return listeners, os.NewFile(uintptr(fd), "ready"), nil
+}
+
+// listen returns the inherited listener for the address if there is one,
+// otherwise it opens a new one.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ln, ok := s.inherited[addr]
+	if ok {
+		delete(s.inherited, addr)
+	} else {
+		var err error
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.listeners = append(s.listeners, ln)
+	s.addrs = append(s.addrs, addr)
+	return ln, nil
+}
+
+// ready closes inherited listeners that are no longer used and tells the
+// parent process, if any, that this process is accepting connections.
+func (s *Server) ready() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for addr, ln := range s.inherited {
+		log.Printf("[INFO] closing unused inherited listener %s", addr)
+		ln.Close()
+	}
+	s.inherited = nil
+
+	if s.readyPipe != nil {
+		s.readyPipe.Write([]byte{1})
+		s.readyPipe.Close()
+		s.readyPipe = nil
+	}
+}
+
+// Upgrade starts a new copy of the running binary with the same arguments
+// and hands it the listening sockets. It returns once the new process is
+// accepting connections, the caller is then expected to Shutdown.
+func (s *Server) Upgrade(ctx context.Context) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.RLock()
+	listeners := s.listeners
+	addrs := s.addrs
+	s.lock.RUnlock()
+
+	if len(listeners) == 0 {
+		return nil, errors.New("not listening")
+	}
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	defer func() {
+		for _, f := range files[3:] {
+			f.Close()
+		}
+	}()
+
+	for _, ln := range listeners {
+		fl, ok := ln.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return nil, fmt.Errorf("cannot hand off listener %s", ln.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	env := []string{}
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, ListenersEnv+"=") || strings.HasPrefix(e, ReadyEnv+"=") {
+			continue
+		}
+		env = append(env, e)
+	}
+	env = append(env,
+		ListenersEnv+"="+strings.Join(addrs, ","),
+		ReadyEnv+"="+strconv.Itoa(len(files)-1),
+	)
+
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: files})
+	for _, f := range files[3:] {
+		f.Close()
+	}
+	files = files[:3]
+	if err != nil {
+		return nil, err
+	}
+
+	readyc := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := r.Read(b)
+		if err == io.EOF {
+			err = errors.New("process exited before it was ready")
+		}
+		readyc <- err
+	}()
+
+	select {
+	case err = <-readyc:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		p.Kill()
+		p.Release()
+		return nil, fmt.Errorf("upgrade: %v", err)
+	}
+	return p, nil
+}
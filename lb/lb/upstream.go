@@ -0,0 +1,129 @@
+package lb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/url"
+)
+
+// UpstreamTLS configures the tls connections from the load balancer to
+// the targets of a handler.
+type UpstreamTLS struct {
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+func (u *UpstreamTLS) Validate() error {
+	errs := ValidationErrors{}
+
+	if (u.CertFile == "") != (u.KeyFile == "") {
+		errs.Add("cert_file", "cert_file and key_file must be set together")
+	} else if _, err := u.TLS(); err != nil {
+		if v, ok := err.(*ValidationError); ok {
+			errs = append(errs, v)
+		} else {
+			errs.Add("cert_file", err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// TLS loads the files of the configuration, an error names the field of
+// the file that failed to load.
+func (u *UpstreamTLS) TLS() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         u.ServerName,
+		InsecureSkipVerify: u.InsecureSkipVerify,
+	}
+
+	if u.CAFile != "" {
+		data, err := ioutil.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, &ValidationError{Field: "ca_file", Message: err.Error()}
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, &ValidationError{Field: "ca_file", Message: "no certificates in " + u.CAFile}
+		}
+	}
+
+	if u.CertFile != "" {
+		certPEM, err := ioutil.ReadFile(u.CertFile)
+		if err != nil {
+			return nil, &ValidationError{Field: "cert_file", Message: err.Error()}
+		}
+		keyPEM, err := ioutil.ReadFile(u.KeyFile)
+		if err != nil {
+			return nil, &ValidationError{Field: "key_file", Message: err.Error()}
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			// the key is at fault unless the certificate does not parse.
+			field := "key_file"
+			if !hasCertificate(certPEM) {
+				field = "cert_file"
+			}
+			return nil, &ValidationError{Field: field, Message: err.Error()}
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// hasCertificate reports whether the pem data starts with a certificate
+// that parses, other blocks before it are skipped.
+func hasCertificate(data []byte) bool {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return false
+		}
+		if block.Type == "CERTIFICATE" {
+			_, err := x509.ParseCertificate(block.Bytes)
+			return err == nil
+		}
+	}
+}
+
+// upstreamTLS returns the tls configuration for the targets, it is loaded
+// once per handler.
+func (h *Handler) upstreamTLS() (*tls.Config, error) {
+	h.tlsOnce.Do(func() {
+		if h.UpstreamTLS == nil {
+			h.tlsConfig = &tls.Config{}
+			return
+		}
+		h.tlsConfig, h.tlsErr = h.UpstreamTLS.TLS()
+	})
+	return h.tlsConfig, h.tlsErr
+}
+
+func secure(u *url.URL) bool {
+	return u.Scheme == "https" || u.Scheme == "wss"
+}
+
+// hostPort returns the address to dial for the url, adding the default
+// port of the scheme.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if secure(u) {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
@@ -0,0 +1,136 @@
+package lb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coldog/proxy/lb/router"
+	"github.com/coldog/proxy/lb/stats"
+)
+
+func TestUpstreamTLS_Mutual(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeCert(t, dir, "client", "client.example.com")
+	client, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(client.Certificate[0])
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	ts.TLS.ClientCAs.AddCert(leaf)
+	ts.StartTLS()
+	defer ts.Close()
+
+	ca := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644)
+
+	s := New(DefaultConfig())
+	err = s.PutHandler(&Handler{
+		Name:    "mtls",
+		Routes:  []*router.Route{{Path: "/mtls"}},
+		Targets: []*Target{{ID: "t1", URL: ts.URL, Weight: 1}},
+		UpstreamTLS: &UpstreamTLS{
+			CAFile:     ca,
+			CertFile:   filepath.Join(dir, "client.crt"),
+			KeyFile:    filepath.Join(dir, "client.key"),
+			ServerName: "example.com",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.PutHandler(&Handler{
+		Name:        "plain",
+		Routes:      []*router.Route{{Path: "/plain"}},
+		Targets:     []*Target{{ID: "t2", URL: ts.URL, Weight: 1}},
+		UpstreamTLS: &UpstreamTLS{CAFile: ca, ServerName: "example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/mtls", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "client.example.com" {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/plain", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502 without client certificate, got %d", w.Code)
+	}
+
+	// health checks connect with the upstream tls configuration as well.
+	hc := &HealthCheck{Path: "/", UnhealthyThreshold: 1}
+	hc.setDefaults()
+	for name, healthy := range map[string]bool{"mtls": true, "plain": false} {
+		client, err := s.handler(name).healthClient(hc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		target := &Target{ID: name, URL: ts.URL, stats: &stats.NoOpStatsCollector{}}
+		target.check(client, hc)
+		if target.Healthy() != healthy {
+			t.Fatalf("%s: expected healthy %v", name, healthy)
+		}
+	}
+}
+
+func TestUpstreamTLS_Validate(t *testing.T) {
+	if err := (&UpstreamTLS{CertFile: "a.crt"}).Validate(); err == nil {
+		t.Fatal("expected error for missing key")
+	}
+	if err := (&UpstreamTLS{CAFile: "/does/not/exist"}).Validate(); err == nil {
+		t.Fatal("expected error for missing ca")
+	}
+
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeCert(t, dir, "client", "client.example.com")
+	cert, key := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	missing := filepath.Join(dir, "missing")
+
+	// errors are reported for the file that failed to load.
+	for _, c := range []struct {
+		u     *UpstreamTLS
+		field string
+	}{
+		{&UpstreamTLS{CAFile: missing}, "ca_file"},
+		{&UpstreamTLS{CAFile: key}, "ca_file"},
+		{&UpstreamTLS{CertFile: missing, KeyFile: key}, "cert_file"},
+		{&UpstreamTLS{CertFile: key, KeyFile: key}, "cert_file"},
+		{&UpstreamTLS{CertFile: cert, KeyFile: missing}, "key_file"},
+		{&UpstreamTLS{CertFile: cert, KeyFile: cert}, "key_file"},
+	} {
+		errs, ok := c.u.Validate().(ValidationErrors)
+		if !ok || len(errs) != 1 || errs[0].Field != c.field {
+			t.Errorf("%+v: expected an error for %s, got %v", c.u, c.field, errs)
+		}
+	}
+	if err := (&UpstreamTLS{CAFile: cert, CertFile: cert, KeyFile: key}).Validate(); err != nil {
+		t.Fatalf("expected valid files, got %v", err)
+	}
+}
@@ -2,32 +2,172 @@ package main
 
 import (
 	"github.com/coldog/proxy/lb/lb"
-	"github.com/coldog/proxy/lb/router"
+	"github.com/coldog/proxy/lb/stats"
+
+	"context"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func main()  {
-	l := lb.New(lb.DefaultConfig())
-
-	l.PutHandler(&lb.Handler{
-		Name: "test",
-		Routes: []*router.Route{
-			{Path: "/tests/"},
-			{Path: "/v1/api/*"},
-		},
-		Strategy: "wrr",
-		Targets: []*lb.Target{
-			{
-				ID: "test-1",
-				URL: "http://localhost:3000",
-				Weight: 10,
-			},
-			{
-				ID: "test-2",
-				URL: "http://localhost:3001",
-				Weight: 15,
-			},
-		},
-	})
-
-	l.Start()
+func main() {
+	config := lb.DefaultConfig()
+
+	path := flag.String("config", "", "handler configuration file, json or yaml, empty to only use the admin api")
+	watch := flag.Duration("watch", 5*time.Second, "interval to check the configuration file for changes, 0 to disable")
+	flag.StringVar(&config.Bind, "bind", config.Bind, "address to bind")
+	flag.IntVar(&config.Port, "port", config.Port, "port to listen on")
+	flag.StringVar(&config.AdminBind, "admin-bind", config.AdminBind, "address to bind the admin api")
+	flag.IntVar(&config.AdminPort, "admin-port", config.AdminPort, "port for the admin api, 0 to disable")
+	tlsPort := flag.Int("tls-port", 0, "port for the https listener, 0 to disable")
+	certDir := flag.String("cert-dir", "certs", "directory with <name>.crt and <name>.key certificate pairs")
+	minTLS := flag.String("tls-min-version", "1.2", "minimum tls version")
+	redirect := flag.Bool("tls-redirect", false, "redirect plain http requests to https")
+	ciphers := flag.String("tls-ciphers", "", "comma separated list of cipher suites, empty for the defaults")
+	acmeDir := flag.String("acme-directory", "", "acme directory url, enables automatic certificates for route hosts")
+	acmeCA := flag.String("acme-ca", "", "ca bundle to verify the acme directory with")
+	acmeEmail := flag.String("acme-email", "", "contact email for the acme account")
+	acmeCache := flag.String("acme-cache", "acme", "directory to persist acme certificates in")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for in flight requests on shutdown")
+	statsBackend := flag.String("stats", string(config.Stats), "stats backend, memory, statsd or noop")
+	statsdAddr := flag.String("statsd-addr", "127.0.0.1:8125", "address of the statsd agent")
+	statsdPrefix := flag.String("statsd-prefix", "", "prefix for statsd metric names")
+	statsdRate := flag.Float64("statsd-sample-rate", 1, "sample rate of statsd counters and timers")
+	statsdFlush := flag.Duration("statsd-flush", time.Second, "interval to flush statsd metrics")
+	dogstatsd := flag.Bool("dogstatsd", false, "send labels as dogstatsd tags")
+	accessLog := flag.String("access-log", "", "access log file, - for stdout, empty to disable")
+	accessFormat := flag.String("access-log-format", "json", "access log format, json, common, combined or a template of {fields}")
+	accessSize := flag.Int64("access-log-max-size", 100, "size in MB after which the access log is rotated, 0 to disable")
+	accessBackups := flag.Int("access-log-max-backups", 5, "number of rotated access logs to keep")
+	flag.BoolVar(&config.TrustRequestID, "trust-request-id", false, "keep valid X-Request-Id headers sent by clients")
+	pidFile := flag.String("pid-file", "", "file to write the process id to, updated on upgrades")
+	flag.Parse()
+
+	config.Stats = stats.StatsCollectorBackend(*statsBackend)
+	if config.Stats == stats.STATSD {
+		config.StatsD = &stats.StatsDConfig{
+			Addr:          *statsdAddr,
+			Prefix:        *statsdPrefix,
+			SampleRate:    *statsdRate,
+			FlushInterval: *statsdFlush,
+			DogStatsD:     *dogstatsd,
+		}
+	}
+
+	if *acmeDir != "" {
+		config.ACME = &lb.ACMEConfig{
+			DirectoryURL: *acmeDir,
+			DirectoryCA:  *acmeCA,
+			Email:        *acmeEmail,
+			CacheDir:     *acmeCache,
+		}
+	}
+
+	if *accessLog != "" {
+		config.AccessLog = &lb.AccessLogConfig{
+			Path:       *accessLog,
+			Format:     *accessFormat,
+			MaxSize:    *accessSize << 20,
+			MaxBackups: *accessBackups,
+		}
+		err := config.AccessLog.Validate()
+		if err != nil {
+			log.Fatalf("[ERROR] invalid access log %v", err)
+		}
+	}
+
+	if *tlsPort != 0 {
+		config.TLS = &lb.TLSConfig{
+			Bind:           config.Bind,
+			Port:           *tlsPort,
+			CertDir:        *certDir,
+			MinVersion:     *minTLS,
+			Redirect:       *redirect,
+			ReloadInterval: 30 * time.Second,
+		}
+		if *ciphers != "" {
+			config.TLS.CipherSuites = strings.Split(*ciphers, ",")
+		}
+	}
+
+	l := lb.New(config)
+
+	quit := make(chan struct{})
+	if *path != "" {
+		loader := lb.NewLoader(l, *path)
+		err := loader.Reload()
+		if err != nil {
+			log.Fatalf("[ERROR] failed to load config %v", err)
+		}
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				log.Printf("[INFO] reloading %s", loader.Path)
+				err := loader.Reload()
+				if err != nil {
+					log.Printf("[ERROR] reload failed %v", err)
+				}
+			}
+		}()
+
+		if *watch > 0 {
+			go loader.Watch(*watch, quit)
+		}
+	}
+
+	done := make(chan struct{})
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	go func() {
+		for sig := range term {
+			if sig != syscall.SIGUSR2 {
+				break
+			}
+
+			// hand the listeners to a new process and drain this one.
+			log.Printf("[INFO] upgrading")
+			ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			p, err := l.Upgrade(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("[ERROR] upgrade failed %v", err)
+				continue
+			}
+			log.Printf("[INFO] upgraded to pid %d", p.Pid)
+			break
+		}
+
+		log.Printf("[INFO] shutting down")
+		close(quit)
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+
+		err := l.Shutdown(ctx)
+		if err != nil {
+			log.Printf("[ERROR] shutdown failed %v", err)
+		}
+		close(done)
+	}()
+
+	if *pidFile != "" {
+		err := ioutil.WriteFile(*pidFile, []byte(strconv.Itoa(os.Getpid())), 0644)
+		if err != nil {
+			log.Fatalf("[ERROR] failed to write pid file %v", err)
+		}
+	}
+
+	err := l.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+	<-done
 }
@@ -1,54 +1,182 @@
 package router
 
 import (
+	"fmt"
 	"regexp"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// Path kinds from most to least specific.
+const (
+	KindExact   = "exact"
+	KindPattern = "pattern"
+	KindPrefix  = "prefix"
+	KindRegex   = "regex"
+	KindAny     = "any"
+)
+
+var kindRank = map[string]int{KindExact: 4, KindPattern: 3, KindPrefix: 2, KindRegex: 1, KindAny: 0}
+
+// Route matches requests on which every predicate that is set matches. The
+// path is exact when anchored like ^/health$, a prefix when it is a plain
+// path like /api/ or only anchored at the start, a pattern when it has
+// :name or *name segments like /users/:id/*rest, and a regex otherwise.
+// A Host that is a plain hostname like api.example.com, optionally anchored
+// or with escaped dots, matches the request host exactly ignoring case and
+// port. Other hosts and the Headers and Query values are regexes.
 type Route struct {
-	Path     string
-	Host     string
-	Headers  map[string]string
-	Priority int
-	key      string
-	pathRegx *regexp.Regexp
-	hostRegx *regexp.Regexp
-	headRegx map[string]*regexp.Regexp
+	Path      string            `json:"path,omitempty"`
+	Host      string            `json:"host,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Methods   []string          `json:"methods,omitempty"`
+	Query     map[string]string `json:"query,omitempty"`
+	Priority  int               `json:"priority,omitempty"`
+	key       string
+	pathKind  string
+	pathLit   string
+	pathRegx  *regexp.Regexp
+	hostName  string
+	hostRegx  *regexp.Regexp
+	headRegx  map[string]*regexp.Regexp
+	queryRegx map[string]*regexp.Regexp
+	methods   map[string]bool
 }
 
 func New() *Router {
-	return &Router{[]*Route{}}
+	r := &Router{}
+	r.matcher.Store(newMatcher([]*Route{}))
+	return r
 }
 
+// Router matches requests against a snapshot of the routes compiled into
+// a matcher. Changes build a new snapshot and swap it in so lookups never
+// wait for them.
 type Router struct {
-	routes []*Route
+	lock    sync.Mutex
+	matcher atomic.Value
+}
+
+func (r *Router) current() *matcher {
+	return r.matcher.Load().(*matcher)
+}
+
+func (r *Router) routes() []*Route {
+	return r.current().routes
 }
 
 func (r *Router) Remove(key string) {
-	for i, route := range r.routes {
-		if route.key == key {
-			r.routes = append(r.routes[0:i], r.routes[i+1:]...)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.matcher.Store(newMatcher(without(r.routes(), key)))
+}
+
+func without(current []*Route, key string) []*Route {
+	routes := make([]*Route, 0, len(current))
+	for _, route := range current {
+		if route.key != key {
+			routes = append(routes, route)
 		}
 	}
+	return routes
 }
 
-func (r *Router) Add(key string, route *Route) (err error) {
-	route.key = key
+var (
+	paramSegment = regexp.MustCompile(`^[:*]\w+$`)
+	methodName   = regexp.MustCompile(`^[A-Za-z]+$`)
+)
 
-	if route.Path != "" {
-		route.pathRegx, err = regexp.Compile(route.Path)
-		if err != nil {
-			return err
+// isPattern reports whether a path has named parameter segments.
+func isPattern(path string) bool {
+	for _, seg := range strings.Split(path, "/") {
+		if paramSegment.MatchString(seg) {
+			return true
+		}
+	}
+	return false
+}
+
+// compilePattern turns /users/:id/*rest into a regex with a named group
+// for each parameter, a * parameter must be the last segment.
+func compilePattern(path string) (*regexp.Regexp, error) {
+	segs := strings.Split(path, "/")
+	expr := strings.Builder{}
+	expr.WriteString("^")
+
+	for i, seg := range segs {
+		if i > 0 {
+			expr.WriteString("/")
+		}
+		switch {
+		case !paramSegment.MatchString(seg):
+			expr.WriteString(regexp.QuoteMeta(seg))
+		case seg[0] == ':':
+			expr.WriteString("(?P<" + seg[1:] + ">[^/]+)")
+		case i != len(segs)-1:
+			return nil, fmt.Errorf("%s must be the last segment of %s", seg, path)
+		default:
+			expr.WriteString("(?P<" + seg[1:] + ">.*)")
+		}
+	}
+
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// isLiteral reports whether s has no regex meta characters.
+func isLiteral(s string) bool {
+	return regexp.QuoteMeta(s) == s
+}
+
+func (route *Route) compilePath() (err error) {
+	path := route.Path
+	route.pathRegx = nil
+	route.pathLit = ""
+
+	switch {
+	case path == "":
+		route.pathKind = KindAny
+	case isPattern(path):
+		route.pathKind = KindPattern
+		route.pathRegx, err = compilePattern(path)
+		route.pathLit = path[:strings.IndexAny(path, ":*")]
+	case strings.HasPrefix(path, "^") && strings.HasSuffix(path, "$") && isLiteral(path[1:len(path)-1]):
+		route.pathKind = KindExact
+		route.pathLit = path[1 : len(path)-1]
+	case isLiteral(strings.TrimPrefix(path, "^")):
+		route.pathKind = KindPrefix
+		route.pathLit = strings.TrimPrefix(path, "^")
+	default:
+		route.pathKind = KindRegex
+		route.pathRegx, err = regexp.Compile(path)
+		if err == nil {
+			route.pathLit, _ = route.pathRegx.LiteralPrefix()
 		}
 	}
+	return err
+}
 
-	if route.Host != "" {
+func (route *Route) Compile() (err error) {
+	err = route.compilePath()
+	if err != nil {
+		return err
+	}
+
+	route.hostName = ""
+	route.hostRegx = nil
+	if host, ok := plainHost(route.Host); ok {
+		route.hostName = host
+	} else if route.Host != "" {
 		route.hostRegx, err = regexp.Compile(route.Host)
 		if err != nil {
 			return err
 		}
 	}
 
+	route.headRegx = nil
 	if len(route.Headers) > 0 {
 		route.headRegx = make(map[string]*regexp.Regexp, len(route.Headers))
 
@@ -61,45 +189,277 @@ func (r *Router) Add(key string, route *Route) (err error) {
 		}
 	}
 
-	if len(r.routes) > 0 {
-		if route.Priority >= r.routes[0].Priority {
-			r.routes = append([]*Route{route}, r.routes...)
-		} else if route.Priority <= r.routes[len(r.routes) - 1].Priority {
-			r.routes = append(r.routes, route)
-		} else {
-			for i := 0; i < len(r.routes)-1; i++ {
-				if route.Priority <= r.routes[i].Priority && route.Priority >= r.routes[i+1].Priority {
-					r.routes = append(r.routes[0:i], append([]*Route{route}, r.routes[i:]...)...)
-					break
-				}
+	route.queryRegx = nil
+	if len(route.Query) > 0 {
+		route.queryRegx = make(map[string]*regexp.Regexp, len(route.Query))
+
+		for key, match := range route.Query {
+			reg, err := regexp.Compile(match)
+			if err != nil {
+				return err
+			}
+			route.queryRegx[key] = reg
+		}
+	}
+
+	route.methods = nil
+	if len(route.Methods) > 0 {
+		route.methods = make(map[string]bool, len(route.Methods))
+
+		for _, method := range route.Methods {
+			if !methodName.MatchString(method) {
+				return fmt.Errorf("invalid method %q", method)
 			}
+			route.methods[strings.ToUpper(method)] = true
 		}
-	} else {
-		r.routes = append(r.routes, route)
 	}
 
 	return nil
 }
 
+// predicates counts the predicates of a route besides its path.
+func (route *Route) predicates() int {
+	n := len(route.headRegx) + len(route.queryRegx)
+	if route.hostName != "" || route.hostRegx != nil {
+		n++
+	}
+	if route.methods != nil {
+		n++
+	}
+	return n
+}
+
+// before orders routes by priority, then by the kind of path, the length
+// of its literal prefix and the number of other predicates, and finally by
+// key so the order does not depend on when routes were added.
+func (route *Route) before(other *Route) bool {
+	if route.Priority != other.Priority {
+		return route.Priority > other.Priority
+	}
+	if a, b := kindRank[route.pathKind], kindRank[other.pathKind]; a != b {
+		return a > b
+	}
+	if a, b := len(route.pathLit), len(other.pathLit); a != b {
+		return a > b
+	}
+	if a, b := route.predicates(), other.predicates(); a != b {
+		return a > b
+	}
+	return route.key < other.key
+}
+
+// Add adds a copy of the route for key.
+func (r *Router) Add(key string, route *Route) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	current := r.routes()
+	routes := make([]*Route, len(current), len(current)+1)
+	copy(routes, current)
+
+	routes, err := insert(routes, key, route)
+	if err != nil {
+		return err
+	}
+	r.matcher.Store(newMatcher(routes))
+	return nil
+}
+
+// Set replaces the routes of key with copies of the given routes at once.
+func (r *Router) Set(key string, routes []*Route) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	next := without(r.routes(), key)
+	for _, route := range routes {
+		var err error
+		next, err = insert(next, key, route)
+		if err != nil {
+			return err
+		}
+	}
+	r.matcher.Store(newMatcher(next))
+	return nil
+}
+
+// insert compiles a copy of the route and inserts it in order, published
+// routes are never modified.
+func insert(routes []*Route, key string, route *Route) ([]*Route, error) {
+	compiled := *route
+	compiled.key = key
+
+	err := compiled.Compile()
+	if err != nil {
+		return routes, err
+	}
+
+	i := sort.Search(len(routes), func(i int) bool {
+		return compiled.before(routes[i])
+	})
+	routes = append(routes, nil)
+	copy(routes[i+1:], routes[i:])
+	routes[i] = &compiled
+	return routes, nil
+}
+
+var hostname = regexp.MustCompile(`^[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)+$`)
+
+// plainHost returns the hostname of a host pattern that is a plain
+// hostname, where dots may be escaped and the pattern may be anchored.
+func plainHost(pattern string) (string, bool) {
+	host := strings.TrimSuffix(strings.TrimPrefix(pattern, "^"), "$")
+	host = strings.ToLower(strings.Replace(host, `\.`, ".", -1))
+	return host, hostname.MatchString(host)
+}
+
+// requestHost returns the host of a request without the port.
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	return strings.ToLower(host)
+}
+
+// Hosts returns the hosts of the routes that are a plain hostname.
+func (r *Router) Hosts() []string {
+	hosts := []string{}
+	seen := map[string]bool{}
+	for _, route := range r.routes() {
+		if host, ok := plainHost(route.Host); ok && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Match returns the key of the first route matching the request.
 func (r *Router) Match(req *http.Request) string {
-	for _, route := range r.routes {
-		if route.pathRegx != nil && route.pathRegx.MatchString(req.URL.Path) {
-			return route.key
+	key, _ := r.Lookup(req)
+	return key
+}
+
+// Lookup returns the key of the first route matching the request and the
+// path params it captured.
+func (r *Router) Lookup(req *http.Request) (string, map[string]string) {
+	return r.matcher.Load().(*matcher).lookup(req)
+}
+
+// lookupLinear checks every route in order, it is what the matcher must
+// agree with.
+func (r *Router) lookupLinear(req *http.Request) (string, map[string]string) {
+	for _, route := range r.routes() {
+		if ok, params, _ := route.match(req); ok {
+			return route.key, params
 		}
+	}
+	return "", nil
+}
+
+// Check describes how a route was checked against a request.
+type Check struct {
+	Key      string            `json:"key"`
+	Priority int               `json:"priority"`
+	Kind     string            `json:"kind"`
+	Matched  bool              `json:"matched"`
+	Reason   string            `json:"reason"`
+	Params   map[string]string `json:"params,omitempty"`
+}
 
-		if route.hostRegx != nil && route.hostRegx.MatchString(req.Host) {
-			return route.key
+// Explain checks the routes in order like Lookup and returns why each one
+// did or did not match, up to the route that matched.
+func (r *Router) Explain(req *http.Request) []Check {
+	checks := []Check{}
+	for _, route := range r.routes() {
+		ok, params, failed := route.match(req)
+		c := Check{
+			Key:      route.key,
+			Priority: route.Priority,
+			Kind:     route.pathKind,
+			Matched:  ok,
+			Params:   params,
 		}
+		if ok {
+			c.Reason = "all predicates matched"
+		} else {
+			c.Reason = failed + " did not match"
+		}
+		checks = append(checks, c)
+		if ok {
+			break
+		}
+	}
+	return checks
+}
 
-		if route.headRegx != nil {
-			for header, match := range route.headRegx {
-				val := req.Header.Get(header)
-				if val != "" && match.MatchString(val) {
-					return route.key
-				}
+// match checks every predicate of the route and returns the first one
+// that failed.
+func (route *Route) match(req *http.Request) (bool, map[string]string, string) {
+	if route.methods != nil && !route.methods[req.Method] {
+		return false, nil, "method"
+	}
 
+	var params map[string]string
+	switch route.pathKind {
+	case KindExact:
+		if req.URL.Path != route.pathLit {
+			return false, nil, "path"
+		}
+	case KindPrefix:
+		if !strings.HasPrefix(req.URL.Path, route.pathLit) {
+			return false, nil, "path"
+		}
+	case KindPattern:
+		m := route.pathRegx.FindStringSubmatch(req.URL.Path)
+		if m == nil {
+			return false, nil, "path"
+		}
+		params = route.params(m)
+	case KindRegex:
+		if !route.pathRegx.MatchString(req.URL.Path) {
+			return false, nil, "path"
+		}
+	}
+
+	if route.hostName != "" && requestHost(req) != route.hostName {
+		return false, nil, "host"
+	}
+	if route.hostRegx != nil && !route.hostRegx.MatchString(req.Host) {
+		return false, nil, "host"
+	}
+
+	for header, match := range route.headRegx {
+		val := req.Header.Get(header)
+		if val == "" || !match.MatchString(val) {
+			return false, nil, "headers"
+		}
+	}
+
+	if route.queryRegx != nil {
+		query := req.URL.Query()
+		for key, match := range route.queryRegx {
+			val, ok := query[key]
+			if !ok || !match.MatchString(val[0]) {
+				return false, nil, "query"
 			}
 		}
 	}
-	return ""
+
+	return true, params, ""
+}
+
+func (route *Route) params(m []string) map[string]string {
+	var params map[string]string
+	for i, name := range route.pathRegx.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if params == nil {
+			params = map[string]string{}
+		}
+		params[name] = m[i]
+	}
+	return params
 }
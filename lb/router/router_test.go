@@ -4,6 +4,7 @@ import (
 	"testing"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 var r *Router
@@ -85,8 +86,14 @@ func TestRouting(t *testing.T) {
 		t.Fail()
 	}
 
+	// the priority of t2 wins over the longer prefix of t3.
 	m = r.Match(mockReq("api.stuff.com", "/v2/api/stuff"))
-	if m != "t3" {
+	if m != "t2" {
+		t.Fail()
+	}
+
+	m = r.Match(mockReq("other.com", "stuff"))
+	if m != "" {
 		t.Fail()
 	}
 }
@@ -102,3 +109,156 @@ func BenchmarkRouter(b *testing.B) {
 
 	result = m
 }
+
+func TestRouter_Hosts(t *testing.T) {
+	r := New()
+	r.Add("t1", &Route{Host: "api.stuff.*"})
+	r.Add("t2", &Route{Host: `^a\.example\.com$`})
+	r.Add("t3", &Route{Host: "b.example.com", Path: "/b"})
+	r.Add("t4", &Route{Host: "b.example.com"})
+
+	hosts := r.Hosts()
+	if len(hosts) != 2 || hosts[0] != "a.example.com" || hosts[1] != "b.example.com" {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+}
+
+func TestRouter_Params(t *testing.T) {
+	r := New()
+	r.Add("user", &Route{Path: "/users/:id"})
+	r.Add("users", &Route{Path: "/users/:id/*rest"})
+
+	key, params := r.Lookup(mockReq("example.com", "users/42/posts/7"))
+	if key != "users" || params["id"] != "42" || params["rest"] != "posts/7" {
+		t.Fatalf("unexpected match %s %v", key, params)
+	}
+
+	key, params = r.Lookup(mockReq("example.com", "users/42"))
+	if key != "user" || params["id"] != "42" {
+		t.Fatalf("unexpected match %s %v", key, params)
+	}
+
+	if key, _ := r.Lookup(mockReq("example.com", "users")); key != "" {
+		t.Fatalf("expected no match, got %s", key)
+	}
+
+	if err := (&Route{Path: "/files/*path/edit"}).Compile(); err == nil {
+		t.Fatal("expected an error for a * param before the last segment")
+	}
+}
+
+func TestRouter_MethodsAndQuery(t *testing.T) {
+	r := New()
+	r.Add("read", &Route{Path: "/items"})
+	r.Add("v2", &Route{Path: "/items", Query: map[string]string{"version": "^2$"}})
+	r.Add("write", &Route{Path: "/items", Methods: []string{"post", "PUT"}})
+
+	req := mockReq("example.com", "items")
+	if m := r.Match(req); m != "read" {
+		t.Fatalf("expected read, got %s", m)
+	}
+
+	req.Method = "POST"
+	if m := r.Match(req); m != "write" {
+		t.Fatalf("expected write, got %s", m)
+	}
+
+	if m := r.Match(mockReq("example.com", "items?version=2")); m != "v2" {
+		t.Fatalf("expected v2, got %s", m)
+	}
+	if m := r.Match(mockReq("example.com", "items?version=3")); m != "read" {
+		t.Fatalf("expected read, got %s", m)
+	}
+
+	if err := (&Route{Methods: []string{"GET /"}}).Compile(); err == nil {
+		t.Fatal("expected an error for an invalid method")
+	}
+}
+
+func TestRouter_AllPredicates(t *testing.T) {
+	r := New()
+	r.Add("api", &Route{Host: `^api\.example\.com$`, Path: "/v1", Headers: map[string]string{"X-Tenant": "^a"}})
+	r.Add("any", &Route{})
+
+	req := mockReq("api.example.com", "v1/users")
+	if m := r.Match(req); m != "any" {
+		t.Fatalf("expected the header to be required, got %s", m)
+	}
+
+	req.Header = http.Header{"X-Tenant": {"acme"}}
+	if m := r.Match(req); m != "api" {
+		t.Fatalf("expected api, got %s", m)
+	}
+
+	req.Host = "www.example.com"
+	if m := r.Match(req); m != "any" {
+		t.Fatalf("expected the host to be required, got %s", m)
+	}
+}
+
+func TestRouter_Specificity(t *testing.T) {
+	r := New()
+	r.Add("regex", &Route{Path: `/api/v\d+/users`})
+	r.Add("any", &Route{})
+	r.Add("api", &Route{Path: "/api/"})
+	r.Add("users", &Route{Path: "/api/v1/users"})
+	r.Add("user", &Route{Path: "/api/v1/users/:id"})
+	r.Add("exact", &Route{Path: "^/api/v1/users/me$"})
+	r.Add("host", &Route{Path: "/api/", Host: "example.com"})
+	r.Add("first", &Route{Path: `^/api/v\d+/users`, Priority: 1})
+
+	for path, want := range map[string]string{
+		"api/v1/users/me": "first",
+		"api/v2/users":    "first",
+		"api/v1/teams":    "host",
+		"health":          "any",
+	} {
+		if m := r.Match(mockReq("example.com", path)); m != want {
+			t.Errorf("%s: expected %s, got %s", path, want, m)
+		}
+	}
+
+	r.Remove("first")
+	for path, want := range map[string]string{
+		"api/v1/users/me":   "exact",
+		"api/v1/users/42":   "user",
+		"api/v1/users/42/x": "users",
+		"api/v1/teams":      "host",
+	} {
+		if m := r.Match(mockReq("example.com", path)); m != want {
+			t.Errorf("%s: expected %s, got %s", path, want, m)
+		}
+	}
+
+	if m := r.Match(mockReq("other.com", "api/v1/teams")); m != "api" {
+		t.Errorf("expected api, got %s", m)
+	}
+	if m := r.Match(mockReq("other.com", "v2/api/v2/users")); m != "regex" {
+		t.Errorf("expected regex, got %s", m)
+	}
+
+	keys := []string{}
+	for _, route := range r.routes() {
+		keys = append(keys, route.key)
+	}
+	if strings.Join(keys, ",") != "exact,user,users,host,api,regex,any" {
+		t.Fatalf("unexpected order %v", keys)
+	}
+}
+
+func TestRouter_Explain(t *testing.T) {
+	r := New()
+	r.Add("post", &Route{Path: "/users/:id", Methods: []string{"POST"}})
+	r.Add("user", &Route{Path: "/users/:id"})
+
+	checks := r.Explain(mockReq("example.com", "users/42"))
+	if len(checks) != 2 {
+		t.Fatalf("expected 2 checks, got %+v", checks)
+	}
+	if checks[0].Key != "post" || checks[0].Matched || checks[0].Reason != "method did not match" {
+		t.Fatalf("unexpected check %+v", checks[0])
+	}
+	if checks[1].Key != "user" || !checks[1].Matched || checks[1].Kind != KindPattern || checks[1].Params["id"] != "42" {
+		t.Fatalf("unexpected check %+v", checks[1])
+	}
+}
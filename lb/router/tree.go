@@ -0,0 +1,169 @@
+package router
+
+import (
+	"net/http"
+)
+
+// matcher is compiled from the routes of a router. Routes with a plain
+// hostname are indexed by host, the others apply to any host. Within a
+// host the exact, prefix and pattern paths are kept in a radix tree and
+// the regex paths and routes without a path are always candidates. The
+// candidates are checked in route order so the result is the same as
+// checking every route.
+type matcher struct {
+	routes []*Route
+	hosts  map[string]*table
+	any    *table
+}
+
+type table struct {
+	root     *node
+	fallback []int
+}
+
+// node is a radix tree node, exact holds the routes whose path ends at the
+// node and prefix the routes whose path starts with it.
+type node struct {
+	path     string
+	children []*node
+	exact    []int
+	prefix   []int
+}
+
+// newMatcher compiles the routes, which must not be modified afterwards.
+func newMatcher(routes []*Route) *matcher {
+	m := &matcher{
+		routes: routes,
+		hosts:  map[string]*table{},
+		any:    &table{root: &node{}},
+	}
+
+	for i, route := range m.routes {
+		t := m.any
+		if route.hostName != "" {
+			t = m.hosts[route.hostName]
+			if t == nil {
+				t = &table{root: &node{}}
+				m.hosts[route.hostName] = t
+			}
+		}
+
+		switch route.pathKind {
+		case KindExact:
+			t.root.insert(route.pathLit, i, true)
+		case KindPrefix, KindPattern:
+			// a pattern only matches paths starting with its literal
+			// prefix, the route checks the rest.
+			t.root.insert(route.pathLit, i, false)
+		default:
+			t.fallback = append(t.fallback, i)
+		}
+	}
+	return m
+}
+
+func (m *matcher) lookup(req *http.Request) (string, map[string]string) {
+	var buf [16]int
+	candidates := m.any.collect(req.URL.Path, buf[:0])
+	if len(m.hosts) > 0 {
+		if t, ok := m.hosts[requestHost(req)]; ok {
+			candidates = t.collect(req.URL.Path, candidates)
+		}
+	}
+
+	for _, i := range candidates {
+		route := m.routes[i]
+		if ok, params, _ := route.match(req); ok {
+			return route.key, params
+		}
+	}
+	return "", nil
+}
+
+// collect merges the candidates of the table into the sorted out.
+func (t *table) collect(path string, out []int) []int {
+	return mergeInts(t.root.collect(path, out), t.fallback)
+}
+
+func (n *node) child(c byte) *node {
+	for _, child := range n.children {
+		if child.path[0] == c {
+			return child
+		}
+	}
+	return nil
+}
+
+func (n *node) insert(path string, i int, exact bool) {
+	for path != "" {
+		child := n.child(path[0])
+		if child == nil {
+			child = &node{path: path}
+			n.children = append(n.children, child)
+		}
+
+		l := 0
+		for l < len(path) && l < len(child.path) && path[l] == child.path[l] {
+			l++
+		}
+
+		if l < len(child.path) {
+			split := &node{path: child.path[:l], children: []*node{child}}
+			child.path = child.path[l:]
+			for j := range n.children {
+				if n.children[j] == child {
+					n.children[j] = split
+				}
+			}
+			child = split
+		}
+
+		path = path[l:]
+		n = child
+	}
+
+	if exact {
+		n.exact = append(n.exact, i)
+	} else {
+		n.prefix = append(n.prefix, i)
+	}
+}
+
+// collect merges the routes along the path, the prefixes of the path and
+// the exact routes of the path itself into the sorted out.
+func (n *node) collect(path string, out []int) []int {
+	for {
+		out = mergeInts(out, n.prefix)
+		if path == "" {
+			return mergeInts(out, n.exact)
+		}
+
+		child := n.child(path[0])
+		if child == nil || len(path) < len(child.path) || path[:len(child.path)] != child.path {
+			return out
+		}
+		path = path[len(child.path):]
+		n = child
+	}
+}
+
+// mergeInts merges the sorted b into the sorted a. It fills a from the
+// back so that no buffer is needed, b must not share memory with a.
+func mergeInts(a, b []int) []int {
+	if len(b) == 0 {
+		return a
+	}
+
+	i := len(a) - 1
+	a = append(a, b...)
+	for j, k := len(b)-1, len(a)-1; j >= 0; k-- {
+		if i >= 0 && a[i] > b[j] {
+			a[k] = a[i]
+			i--
+		} else {
+			a[k] = b[j]
+			j--
+		}
+	}
+	return a
+}
@@ -0,0 +1,166 @@
+package router
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// largeRouter builds a route table like a large deployment, n routes
+// spread over hosts with exact, prefix, pattern and a few regex paths.
+func largeRouter(n int) *Router {
+	r := New()
+	for i := 0; i < n; i++ {
+		host := fmt.Sprintf("svc%d.example.com", i%50)
+		key := fmt.Sprintf("r%d", i)
+
+		switch i % 10 {
+		case 0:
+			r.Add(key, &Route{Host: host, Path: fmt.Sprintf("^/api/v1/s%d/health$", i)})
+		case 1:
+			r.Add(key, &Route{Path: fmt.Sprintf("/api/v1/s%d/users/:id", i)})
+		case 2:
+			r.Add(key, &Route{Path: fmt.Sprintf(`/api/v\d+/s%d/`, i)})
+		case 3:
+			r.Add(key, &Route{Host: host, Path: fmt.Sprintf("/api/v1/s%d/", i), Methods: []string{"POST"}})
+		default:
+			r.Add(key, &Route{Host: host, Path: fmt.Sprintf("/api/v1/s%d/", i)})
+		}
+	}
+	r.Add("default", &Route{Path: "/"})
+	return r
+}
+
+func largeRequests(n int) []*http.Request {
+	rnd := rand.New(rand.NewSource(1))
+	methods := []string{"GET", "POST"}
+	paths := []string{"/api/v1/s%d/health", "/api/v1/s%d/users/42", "/api/v2/s%d/x", "/api/v1/s%d/items", "/other/%d"}
+
+	reqs := []*http.Request{}
+	for i := 0; i < 1000; i++ {
+		s := rnd.Intn(n + 10)
+		u, _ := url.Parse(fmt.Sprintf(paths[rnd.Intn(len(paths))], s))
+		reqs = append(reqs, &http.Request{
+			Method: methods[rnd.Intn(len(methods))],
+			Host:   fmt.Sprintf("svc%d.example.com:8080", rnd.Intn(60)),
+			URL:    u,
+		})
+	}
+	return reqs
+}
+
+func TestMatcher_AgreesWithLinear(t *testing.T) {
+	r := largeRouter(2000)
+	for _, req := range largeRequests(2000) {
+		key, params := r.Lookup(req)
+		want, wantParams := r.lookupLinear(req)
+		if key != want || fmt.Sprint(params) != fmt.Sprint(wantParams) {
+			t.Fatalf("%s %s%s: expected %s %v, got %s %v", req.Method, req.Host, req.URL.Path, want, wantParams, key, params)
+		}
+	}
+
+	// the matcher is rebuilt on changes.
+	req := largeRequests(2000)[0]
+	key, _ := r.Lookup(req)
+	r.Remove(key)
+	if k, _ := r.Lookup(req); k == key {
+		t.Fatalf("expected %s to be removed", key)
+	}
+	got, _ := r.Lookup(req)
+	if want, _ := r.lookupLinear(req); got != want {
+		t.Fatalf("expected %s after remove, got %s", want, got)
+	}
+}
+
+func TestMatcher_Tree(t *testing.T) {
+	r := New()
+	r.Add("api", &Route{Path: "/api"})
+	r.Add("apis", &Route{Path: "/apis/"})
+	r.Add("app", &Route{Path: "^/app$"})
+	r.Add("host", &Route{Host: "A.example.com", Path: "/api"})
+
+	for _, c := range []struct{ host, path, want string }{
+		{"example.com", "/api", "api"},
+		{"example.com", "/apis/x", "apis"},
+		{"example.com", "/apis", "api"},
+		{"example.com", "/app", "app"},
+		{"example.com", "/app/x", ""},
+		{"example.com", "/ap", ""},
+		{"a.example.com:443", "/api/x", "host"},
+	} {
+		req := &http.Request{Method: "GET", Host: c.host, URL: &url.URL{Path: c.path}}
+		if m := r.Match(req); m != c.want {
+			t.Errorf("%s%s: expected %q, got %q", c.host, c.path, c.want, m)
+		}
+	}
+}
+
+// regexRouter builds a route table of regex paths, which are candidates
+// for every request, half of them for a single host.
+func regexRouter(n int) *Router {
+	r := New()
+	for i := 0; i < n; i++ {
+		route := &Route{Path: fmt.Sprintf(`^/r%d/\w+$`, i)}
+		if i%2 == 0 {
+			route.Host = "api.example.com"
+		}
+		r.Add(fmt.Sprintf("r%d", i), route)
+	}
+	return r
+}
+
+func regexRequests(n int) []*http.Request {
+	rnd := rand.New(rand.NewSource(1))
+	hosts := []string{"api.example.com", "www.example.com"}
+
+	reqs := []*http.Request{}
+	for i := 0; i < 1000; i++ {
+		u, _ := url.Parse(fmt.Sprintf("/r%d/x", rnd.Intn(n)))
+		reqs = append(reqs, &http.Request{
+			Method: "GET",
+			Host:   hosts[rnd.Intn(len(hosts))],
+			URL:    u,
+		})
+	}
+	return reqs
+}
+
+func TestMatcher_RegexAgreesWithLinear(t *testing.T) {
+	r := regexRouter(200)
+	for _, req := range regexRequests(200) {
+		key, _ := r.Lookup(req)
+		if want, _ := r.lookupLinear(req); key != want {
+			t.Fatalf("%s%s: expected %s, got %s", req.Host, req.URL.Path, want, key)
+		}
+	}
+}
+
+func TestMatcher_MergeInts(t *testing.T) {
+	a := mergeInts([]int{1, 4, 6}, []int{0, 2, 5, 7})
+	if fmt.Sprint(a) != "[0 1 2 4 5 6 7]" {
+		t.Fatalf("unexpected merge %v", a)
+	}
+}
+
+func benchmarkLookup(b *testing.B, reqs []*http.Request, lookup func(*http.Request) (string, map[string]string)) {
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		result, _ = lookup(reqs[n%len(reqs)])
+	}
+}
+
+func BenchmarkRouter_Linear(b *testing.B) {
+	benchmarkLookup(b, largeRequests(2000), largeRouter(2000).lookupLinear)
+}
+
+func BenchmarkRouter_Tree(b *testing.B) {
+	benchmarkLookup(b, largeRequests(2000), largeRouter(2000).Lookup)
+}
+
+func BenchmarkRouter_Regex(b *testing.B) {
+	benchmarkLookup(b, regexRequests(2000), regexRouter(2000).Lookup)
+}
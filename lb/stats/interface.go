@@ -10,6 +10,7 @@ type StatsCollectorBackend string
 const (
 	MEMORY StatsCollectorBackend = "memory"
 	NOOP StatsCollectorBackend = "noop"
+	STATSD StatsCollectorBackend = "statsd"
 )
 
 type StatsCollector interface {
@@ -17,6 +18,8 @@ type StatsCollector interface {
 	SetTime(key string, t time.Time)
 	SetPoint(key string, value float64)
 	GetIncrement(key string) int64
+	GetPercentile(key string, p float64) time.Duration
+	GetRate(key string, window time.Duration) float64
 }
 
 type NoOpStatsCollector struct {}
@@ -25,58 +28,107 @@ func (n *NoOpStatsCollector) SetIncrement(key string, amount int) {}
 func (n *NoOpStatsCollector) SetTime(key string, t time.Time) {}
 func (n *NoOpStatsCollector) SetPoint(key string, value float64) {}
 func (n *NoOpStatsCollector) GetIncrement(key string) int64 { return int64(0)}
-
-type point struct {
-	t time.Time
-	p float64
-}
+func (n *NoOpStatsCollector) GetPercentile(key string, p float64) time.Duration { return 0 }
+func (n *NoOpStatsCollector) GetRate(key string, window time.Duration) float64 { return 0 }
 
 func New(t StatsCollectorBackend) StatsCollector {
 	if t == MEMORY {
 		return &InMemStatsCollector{
 			lockIncr: &sync.RWMutex{},
-			increments: map[string]int64{},
+			increments: map[string]*counter{},
 			lockPts: &sync.Mutex{},
-			points: map[string][]point{},
+			points: map[string]float64{},
 			lockTms: &sync.Mutex{},
-			timer: map[string][]time.Duration{},
+			timer: map[string]*histogram{},
+			now: time.Now,
 		}
 	} else {
 		return &NoOpStatsCollector{}
 	}
 }
 
+// InMemStatsCollector keeps counters, the last value of each point and
+// latency histograms in memory. Memory use is bounded by the number of keys,
+// recent values are kept for a sliding Window to answer GetPercentile and
+// GetRate.
 type InMemStatsCollector struct {
 	lockIncr *sync.RWMutex
-	increments map[string]int64
+	increments map[string]*counter
 
 	lockPts *sync.Mutex
-	points map[string][]point
+	points map[string]float64
 
 	lockTms *sync.Mutex
-	timer map[string][]time.Duration
+	timer map[string]*histogram
+
+	now func() time.Time
 }
 
 func (l *InMemStatsCollector) SetIncrement(key string, amount int) {
 	l.lockIncr.Lock()
 	defer l.lockIncr.Unlock()
-	l.increments[key] += int64(amount)
+	c, ok := l.increments[key]
+	if !ok {
+		c = &counter{}
+		l.increments[key] = c
+	}
+	c.add(l.now(), int64(amount))
 }
 
 func (l *InMemStatsCollector) SetPoint(key string, value float64) {
 	l.lockPts.Lock()
 	defer l.lockPts.Unlock()
-	l.points[key] = append(l.points[key], point{time.Now(), value})
+	l.points[key] = value
 }
 
 func (l *InMemStatsCollector) SetTime(key string, t time.Time) {
+	now := l.now()
+
 	l.lockTms.Lock()
 	defer l.lockTms.Unlock()
-	l.timer[key] = append(l.timer[key], time.Duration(time.Now().UnixNano() - t.UnixNano()))
+	h, ok := l.timer[key]
+	if !ok {
+		h = newHistogram()
+		l.timer[key] = h
+	}
+	h.observe(now, now.Sub(t))
 }
 
 func (l *InMemStatsCollector) GetIncrement(key string) int64 {
 	l.lockIncr.RLock()
 	defer l.lockIncr.RUnlock()
-	return l.increments[key]
+	if c, ok := l.increments[key]; ok {
+		return c.total
+	}
+	return 0
+}
+
+// GetPercentile returns the p-th percentile, 0 to 100, of the durations
+// recorded for a timer key within the last Window.
+func (l *InMemStatsCollector) GetPercentile(key string, p float64) time.Duration {
+	l.lockTms.Lock()
+	defer l.lockTms.Unlock()
+	if h, ok := l.timer[key]; ok {
+		return h.percentile(l.now(), p)
+	}
+	return 0
+}
+
+// GetRate returns the per second rate of a counter key, or of the
+// observations of a timer key, over a window of at most Window.
+func (l *InMemStatsCollector) GetRate(key string, window time.Duration) float64 {
+	l.lockIncr.RLock()
+	c, ok := l.increments[key]
+	if ok {
+		defer l.lockIncr.RUnlock()
+		return c.rate(l.now(), window)
+	}
+	l.lockIncr.RUnlock()
+
+	l.lockTms.Lock()
+	defer l.lockTms.Unlock()
+	if h, ok := l.timer[key]; ok {
+		return h.rate(l.now(), window)
+	}
+	return 0
 }
@@ -0,0 +1,105 @@
+package stats
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func testCollector(now *time.Time) *InMemStatsCollector {
+	l := New(MEMORY).(*InMemStatsCollector)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestInMem_Percentile(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := testCollector(&now)
+
+	for i := 1; i <= 1000; i++ {
+		l.SetTime("latency", now.Add(-time.Duration(i)*time.Millisecond))
+	}
+
+	for _, c := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{50, 500 * time.Millisecond},
+		{90, 900 * time.Millisecond},
+		{99, 990 * time.Millisecond},
+	} {
+		got := l.GetPercentile("latency", c.p)
+		if math.Abs(float64(got-c.want)) > float64(c.want)*0.15 {
+			t.Errorf("p%v: expected about %v, got %v", c.p, c.want, got)
+		}
+	}
+
+	if l.GetPercentile("missing", 50) != 0 {
+		t.Error("expected 0 for a missing key")
+	}
+}
+
+func TestInMem_Window(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := testCollector(&now)
+
+	for i := 0; i < 100; i++ {
+		l.SetTime("latency", now.Add(-time.Second))
+	}
+
+	now = now.Add(Window / 2)
+	for i := 0; i < 100; i++ {
+		l.SetTime("latency", now.Add(-10*time.Millisecond))
+	}
+	if p := l.GetPercentile("latency", 90); p < 500*time.Millisecond {
+		t.Fatalf("expected old values in the window, got %v", p)
+	}
+
+	// the first values fall out of the window.
+	now = now.Add(Window/2 + slotSize)
+	if p := l.GetPercentile("latency", 90); p > 20*time.Millisecond {
+		t.Fatalf("expected old values to expire, got %v", p)
+	}
+
+	now = now.Add(Window)
+	if p := l.GetPercentile("latency", 90); p != 0 {
+		t.Fatalf("expected an empty window, got %v", p)
+	}
+}
+
+func TestInMem_Rate(t *testing.T) {
+	now := time.Unix(1200, 0)
+	l := testCollector(&now)
+
+	for i := 0; i < 60; i++ {
+		now = now.Add(time.Second)
+		l.SetIncrement("requests", 10)
+	}
+
+	if r := l.GetRate("requests", 30*time.Second); math.Abs(r-10) > 1 {
+		t.Fatalf("expected about 10/s, got %v", r)
+	}
+	if l.GetIncrement("requests") != 600 {
+		t.Fatalf("expected total of 600, got %d", l.GetIncrement("requests"))
+	}
+
+	now = now.Add(2 * Window)
+	if r := l.GetRate("requests", Window); r != 0 {
+		t.Fatalf("expected no rate after the window, got %v", r)
+	}
+	if l.GetIncrement("requests") != 600 {
+		t.Fatal("total should not expire")
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	for _, d := range []time.Duration{1, 3, 4, 7, 100, time.Microsecond, time.Millisecond, 3 * time.Second, time.Hour} {
+		v := bucketValue(bucketOf(d))
+		if math.Abs(float64(v-d)) > float64(d)*0.13 {
+			t.Errorf("%v: bucket value %v too far off", d, v)
+		}
+	}
+	if bucketOf(100*time.Hour) != numBuckets-1 {
+		t.Error("expected large durations in the last bucket")
+	}
+}
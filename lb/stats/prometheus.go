@@ -0,0 +1,153 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Buckets are the upper bounds in seconds of the latency histograms.
+var Buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Exporter is implemented by collectors that can write their metrics in the
+// Prometheus text format.
+type Exporter interface {
+	WritePrometheus(w io.Writer) error
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Key builds a metric key from a name and label pairs, for example
+// Key("lb_requests_total", "handler", "api") is
+// `lb_requests_total{handler="api"}`.
+func Key(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	b := strings.Builder{}
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// SplitKey returns the name of a key and its labels without braces.
+func SplitKey(key string) (name, labels string) {
+	i := strings.IndexByte(key, '{')
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], strings.TrimSuffix(key[i+1:], "}")
+}
+
+// WriteMetric writes samples of the given type, grouped by metric name and
+// sorted so the output is stable between scrapes.
+func WriteMetric(w io.Writer, typ string, samples map[string]float64) {
+	keys := make([]string, 0, len(samples))
+	for k := range samples {
+		keys = append(keys, k)
+	}
+	sortedByName(keys)
+
+	written := map[string]bool{}
+	for _, k := range keys {
+		name, _ := SplitKey(k)
+		if !written[name] {
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+			written[name] = true
+		}
+		fmt.Fprintf(w, "%s %s\n", k, formatFloat(samples[k]))
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sortedByName orders keys by metric name so each family is written in
+// one block.
+func sortedByName(keys []string) {
+	sort.Slice(keys, func(i, j int) bool {
+		ni, _ := SplitKey(keys[i])
+		nj, _ := SplitKey(keys[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return keys[i] < keys[j]
+	})
+}
+
+func writeHistogram(w io.Writer, key string, h *histogram) {
+	name, labels := SplitKey(key)
+	if labels != "" {
+		labels += ","
+	}
+
+	for i, b := range Buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, formatFloat(b), h.cumulative[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+
+	suffix := ""
+	if labels != "" {
+		suffix = "{" + strings.TrimSuffix(labels, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, suffix, formatFloat(h.sum.Seconds()))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, suffix, h.count)
+}
+
+// WritePrometheus writes increments as counters, points as gauges and
+// timers as histograms.
+func (l *InMemStatsCollector) WritePrometheus(out io.Writer) error {
+	w := bufio.NewWriter(out)
+
+	l.lockIncr.RLock()
+	counters := make(map[string]float64, len(l.increments))
+	for k, c := range l.increments {
+		counters[k] = float64(c.total)
+	}
+	l.lockIncr.RUnlock()
+	WriteMetric(w, "counter", counters)
+
+	l.lockPts.Lock()
+	gauges := make(map[string]float64, len(l.points))
+	for k, v := range l.points {
+		gauges[k] = v
+	}
+	l.lockPts.Unlock()
+	WriteMetric(w, "gauge", gauges)
+
+	l.lockTms.Lock()
+	defer l.lockTms.Unlock()
+
+	keys := make([]string, 0, len(l.timer))
+	for k := range l.timer {
+		keys = append(keys, k)
+	}
+	sortedByName(keys)
+
+	written := map[string]bool{}
+	for _, k := range keys {
+		name, _ := SplitKey(k)
+		if !written[name] {
+			fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+			written[name] = true
+		}
+		writeHistogram(w, k, l.timer[k])
+	}
+
+	return w.Flush()
+}
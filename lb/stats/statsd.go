@@ -0,0 +1,234 @@
+package stats
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFlushInterval = time.Second
+	defaultPacketSize    = 1432
+)
+
+// StatsDConfig configures the StatsD backend.
+type StatsDConfig struct {
+	// Addr is the host:port of the StatsD agent.
+	Addr   string
+	Prefix string
+
+	// SampleRate between 0 and 1 applies to counters and timers, 0 sends
+	// everything.
+	SampleRate    float64
+	FlushInterval time.Duration
+	MaxPacketSize int
+
+	// DogStatsD sends labels and Tags as DogStatsD tags, otherwise label
+	// values are appended to the metric name.
+	DogStatsD bool
+	Tags      []string
+}
+
+// StatsDCollector batches metrics into UDP packets for a StatsD agent. The
+// metrics are also kept in memory so they can still be queried and
+// exported.
+type StatsDCollector struct {
+	*InMemStatsCollector
+
+	config StatsDConfig
+	conn   net.Conn
+	lock   sync.Mutex
+	buf    bytes.Buffer
+	rand   func() float64
+	quit   chan struct{}
+	once   sync.Once
+}
+
+// NewStatsD connects to the agent and starts flushing on the configured
+// interval until Close is called.
+func NewStatsD(c StatsDConfig) (*StatsDCollector, error) {
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultFlushInterval
+	}
+	if c.MaxPacketSize <= 0 {
+		c.MaxPacketSize = defaultPacketSize
+	}
+	if c.SampleRate <= 0 || c.SampleRate > 1 {
+		c.SampleRate = 1
+	}
+	if c.Prefix != "" && !strings.HasSuffix(c.Prefix, ".") {
+		c.Prefix += "."
+	}
+
+	conn, err := net.Dial("udp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StatsDCollector{
+		InMemStatsCollector: New(MEMORY).(*InMemStatsCollector),
+		config:              c,
+		conn:                conn,
+		rand:                rand.Float64,
+		quit:                make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *StatsDCollector) SetIncrement(key string, amount int) {
+	s.InMemStatsCollector.SetIncrement(key, amount)
+	s.send(key, strconv.Itoa(amount), "c", true)
+}
+
+func (s *StatsDCollector) SetTime(key string, t time.Time) {
+	s.InMemStatsCollector.SetTime(key, t)
+	ms := float64(time.Since(t)) / float64(time.Millisecond)
+	s.send(key, strconv.FormatFloat(ms, 'f', -1, 64), "ms", true)
+}
+
+func (s *StatsDCollector) SetPoint(key string, value float64) {
+	s.InMemStatsCollector.SetPoint(key, value)
+	s.send(key, strconv.FormatFloat(value, 'f', -1, 64), "g", false)
+}
+
+// Flush sends the buffered metrics.
+func (s *StatsDCollector) Flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flush()
+}
+
+// Close flushes the remaining metrics and closes the connection.
+func (s *StatsDCollector) Close() error {
+	s.once.Do(func() { close(s.quit) })
+	s.Flush()
+	return s.conn.Close()
+}
+
+func (s *StatsDCollector) run() {
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+			s.Flush()
+		}
+	}
+}
+
+func (s *StatsDCollector) send(key, value, typ string, sampled bool) {
+	rate := s.config.SampleRate
+	if sampled && rate < 1 && s.rand() >= rate {
+		return
+	}
+
+	line := s.line(key, value, typ, sampled)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.buf.Len() > 0 && s.buf.Len()+1+len(line) > s.config.MaxPacketSize {
+		s.flush()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line)
+}
+
+// line formats a metric as name:value|type|@rate|#tags.
+func (s *StatsDCollector) line(key, value, typ string, sampled bool) string {
+	name, labels := SplitKey(key)
+	pairs := parseLabels(labels)
+
+	b := strings.Builder{}
+	b.WriteString(s.config.Prefix)
+	b.WriteString(name)
+	if !s.config.DogStatsD {
+		for _, p := range pairs {
+			b.WriteByte('.')
+			b.WriteString(sanitize(p[1]))
+		}
+	}
+
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(typ)
+
+	if sampled && s.config.SampleRate < 1 {
+		b.WriteString("|@")
+		b.WriteString(strconv.FormatFloat(s.config.SampleRate, 'f', -1, 64))
+	}
+
+	if s.config.DogStatsD && (len(pairs) > 0 || len(s.config.Tags) > 0) {
+		b.WriteString("|#")
+		tags := append([]string{}, s.config.Tags...)
+		for _, p := range pairs {
+			tags = append(tags, sanitize(p[0])+":"+sanitize(p[1]))
+		}
+		b.WriteString(strings.Join(tags, ","))
+	}
+	return b.String()
+}
+
+// flush must be called with the lock held.
+func (s *StatsDCollector) flush() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	_, err := s.conn.Write(s.buf.Bytes())
+	if err != nil {
+		log.Printf("[ERROR] statsd: %v", err)
+	}
+	s.buf.Reset()
+}
+
+var statsdReplacer = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+
+func sanitize(s string) string {
+	return statsdReplacer.Replace(s)
+}
+
+// parseLabels splits the labels of a key built with Key into name and
+// value pairs.
+func parseLabels(labels string) [][2]string {
+	pairs := [][2]string{}
+	for len(labels) > 0 {
+		eq := strings.Index(labels, `="`)
+		if eq < 0 {
+			break
+		}
+		name := labels[:eq]
+		rest := labels[eq+2:]
+
+		value := strings.Builder{}
+		i := 0
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] == '\\' && i+1 < len(rest) {
+				i++
+				if rest[i] == 'n' {
+					value.WriteByte('\n')
+					continue
+				}
+			}
+			value.WriteByte(rest[i])
+		}
+		pairs = append(pairs, [2]string{name, value.String()})
+
+		if i < len(rest) {
+			i++
+		}
+		labels = strings.TrimPrefix(rest[i:], ",")
+	}
+	return pairs
+}
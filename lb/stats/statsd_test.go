@@ -0,0 +1,138 @@
+package stats
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func udpListener(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func readPacket(t *testing.T, conn *net.UDPConn) []string {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+func TestStatsD_Batch(t *testing.T) {
+	conn := udpListener(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(StatsDConfig{Addr: conn.LocalAddr().String(), Prefix: "lb", FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetIncrement(Key("lb_requests_total", "handler", "api.v1"), 2)
+	s.SetPoint("lb_targets", 3)
+	s.SetTime(Key("lb_upstream_duration_seconds", "handler", "api", "target", "t1"), time.Now().Add(-10*time.Millisecond))
+	s.Flush()
+
+	lines := readPacket(t, conn)
+	if len(lines) != 3 {
+		t.Fatalf("expected one packet with 3 lines, got %q", lines)
+	}
+	if lines[0] != "lb.lb_requests_total.api_v1:2|c" || lines[1] != "lb.lb_targets:3|g" {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+	if !strings.HasPrefix(lines[2], "lb.lb_upstream_duration_seconds.api.t1:") || !strings.HasSuffix(lines[2], "|ms") {
+		t.Fatalf("unexpected timer %q", lines[2])
+	}
+
+	// values are still available locally.
+	if s.GetIncrement(Key("lb_requests_total", "handler", "api.v1")) != 2 {
+		t.Fatal("increment not kept in memory")
+	}
+}
+
+func TestStatsD_DogStatsD(t *testing.T) {
+	conn := udpListener(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(StatsDConfig{
+		Addr:          conn.LocalAddr().String(),
+		SampleRate:    0.5,
+		FlushInterval: time.Hour,
+		DogStatsD:     true,
+		Tags:          []string{"env:test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	sample := []float64{0.1, 0.9}
+	s.rand = func() float64 {
+		v := sample[0]
+		sample = sample[1:]
+		return v
+	}
+
+	s.SetIncrement(Key("lb_rejected_total", "handler", "api", "reason", `say "hi"`), 1)
+	s.SetIncrement(Key("lb_rejected_total", "handler", "api", "reason", "dropped"), 1)
+	s.Flush()
+
+	lines := readPacket(t, conn)
+	want := `lb_rejected_total:1|c|@0.5|#env:test,handler:api,reason:say_"hi"`
+	if len(lines) != 1 || lines[0] != want {
+		t.Fatalf("expected %q, got %q", want, lines)
+	}
+}
+
+func TestStatsD_PacketSize(t *testing.T) {
+	conn := udpListener(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(StatsDConfig{Addr: conn.LocalAddr().String(), FlushInterval: time.Hour, MaxPacketSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		s.SetIncrement("requests", 1)
+	}
+	s.Flush()
+
+	lines := []string{}
+	for len(lines) < 10 {
+		packet := readPacket(t, conn)
+		if n := len(strings.Join(packet, "\n")); n > 64 {
+			t.Fatalf("packet of %d bytes exceeds the maximum", n)
+		}
+		lines = append(lines, packet...)
+	}
+	sort.Strings(lines)
+	if lines[0] != "requests:1|c" || lines[9] != "requests:1|c" {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+}
+
+func TestStatsD_FlushInterval(t *testing.T) {
+	conn := udpListener(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(StatsDConfig{Addr: conn.LocalAddr().String(), FlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetIncrement("requests", 1)
+	if lines := readPacket(t, conn); lines[0] != "requests:1|c" {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+}
@@ -0,0 +1,199 @@
+package stats
+
+import (
+	"math/bits"
+	"time"
+)
+
+// Timers and counters keep their recent values in a ring of slots covering
+// the sliding Window, older slots are reused as time moves on so memory
+// stays constant.
+const (
+	Window    = time.Minute
+	slotCount = 6
+	slotSize  = Window / slotCount
+
+	// durations are bucketed by their power of two with subBuckets linear
+	// buckets each, about 12% precision up to 2^maxExp ns (about 73 min).
+	subBits    = 2
+	subBuckets = 1 << subBits
+	maxExp     = 42
+	numBuckets = (maxExp + 1) * subBuckets
+)
+
+func slotID(now time.Time) int64 {
+	return now.UnixNano() / int64(slotSize)
+}
+
+// bucketOf returns the bucket index of a duration in nanoseconds.
+func bucketOf(d time.Duration) int {
+	if d < subBuckets {
+		if d < 0 {
+			return 0
+		}
+		return int(d)
+	}
+	e := bits.Len64(uint64(d)) - 1
+	if e > maxExp {
+		return numBuckets - 1
+	}
+	sub := int(uint64(d)>>uint(e-subBits)) & (subBuckets - 1)
+	return e*subBuckets + sub
+}
+
+// bucketValue returns the midpoint of a bucket.
+func bucketValue(i int) time.Duration {
+	e, sub := i/subBuckets, i%subBuckets
+	if e < subBits {
+		return time.Duration(i)
+	}
+	lower := int64(subBuckets+sub) << uint(e-subBits)
+	width := int64(1) << uint(e-subBits)
+	return time.Duration(lower + width/2)
+}
+
+type counterSlot struct {
+	id int64
+	n  int64
+}
+
+// counter is a monotonic total along with the recent increments.
+type counter struct {
+	total int64
+	slots [slotCount]counterSlot
+}
+
+func (c *counter) add(now time.Time, n int64) {
+	c.total += n
+
+	id := slotID(now)
+	s := &c.slots[id%slotCount]
+	if s.id != id {
+		*s = counterSlot{id: id}
+	}
+	s.n += n
+}
+
+// rate returns the increments per second over the window, the current
+// slot is only counted for the time that has passed in it.
+func (c *counter) rate(now time.Time, window time.Duration) float64 {
+	return rate(now, window, func(id int64) int64 {
+		s := c.slots[id%slotCount]
+		if s.id != id {
+			return 0
+		}
+		return s.n
+	})
+}
+
+func rate(now time.Time, window time.Duration, slot func(id int64) int64) float64 {
+	if window <= 0 {
+		return 0
+	}
+	if window > Window {
+		window = Window
+	}
+
+	id := slotID(now)
+	n := int((window + slotSize - 1) / slotSize)
+
+	sum := int64(0)
+	for i := 0; i < n; i++ {
+		sum += slot(id - int64(i))
+	}
+
+	elapsed := time.Duration(now.UnixNano()%int64(slotSize)) + time.Duration(n-1)*slotSize
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(sum) / elapsed.Seconds()
+}
+
+type histogramSlot struct {
+	id     int64
+	n      int64
+	counts [numBuckets]int64
+}
+
+// histogram records durations into the fixed Prometheus Buckets since the
+// start and into log buckets for the sliding window.
+type histogram struct {
+	count      int64
+	sum        time.Duration
+	cumulative []int64
+	slots      [slotCount]histogramSlot
+}
+
+func newHistogram() *histogram {
+	return &histogram{cumulative: make([]int64, len(Buckets))}
+}
+
+func (h *histogram) observe(now time.Time, d time.Duration) {
+	h.count++
+	h.sum += d
+	for i, b := range Buckets {
+		if d.Seconds() <= b {
+			h.cumulative[i]++
+		}
+	}
+
+	id := slotID(now)
+	s := &h.slots[id%slotCount]
+	if s.id != id {
+		*s = histogramSlot{id: id}
+	}
+	s.n++
+	s.counts[bucketOf(d)]++
+}
+
+func (h *histogram) rate(now time.Time, window time.Duration) float64 {
+	return rate(now, window, func(id int64) int64 {
+		s := &h.slots[id%slotCount]
+		if s.id != id {
+			return 0
+		}
+		return s.n
+	})
+}
+
+// percentile returns the p-th percentile, 0 to 100, of the durations
+// observed in the window.
+func (h *histogram) percentile(now time.Time, p float64) time.Duration {
+	oldest := slotID(now) - slotCount + 1
+
+	total := int64(0)
+	counts := [numBuckets]int64{}
+	for i := range h.slots {
+		s := &h.slots[i]
+		if s.id < oldest || s.n == 0 {
+			continue
+		}
+		total += s.n
+		for b, n := range s.counts {
+			counts[b] += n
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+
+	if p < 0 {
+		p = 0
+	} else if p > 100 {
+		p = 100
+	}
+
+	rank := int64(p/100*float64(total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	seen := int64(0)
+	for b, n := range counts {
+		seen += n
+		if seen >= rank {
+			return bucketValue(b)
+		}
+	}
+	return bucketValue(numBuckets - 1)
+}
@@ -0,0 +1,193 @@
+package testing
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const upgradeConfig = `
+handlers:
+  - name: upgrade
+    strategy: rr
+    routes:
+      - path: /
+    targets:
+      - id: backend
+        url: %s
+        weight: 1
+`
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func readPid(t *testing.T, path string) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(string(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pid
+}
+
+// TestUpgrade builds the lb binary, hot upgrades it under load and checks
+// that no request fails during the swap.
+func TestUpgrade(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		fmt.Fprintf(w, "HI!")
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "lb-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bin := filepath.Join(dir, "lb")
+	out, err := exec.Command("go", "build", "-o", bin, "github.com/coldog/proxy/lb").CombinedOutput()
+	if err != nil {
+		t.Fatalf("build failed %v: %s", err, out)
+	}
+
+	config := filepath.Join(dir, "lb.yaml")
+	err = ioutil.WriteFile(config, []byte(fmt.Sprintf(upgradeConfig, backend.URL)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+	pidFile := filepath.Join(dir, "lb.pid")
+	cmd := exec.Command(bin,
+		"-config", config,
+		"-bind", "127.0.0.1",
+		"-port", strconv.Itoa(port),
+		"-admin-port", "0",
+		"-watch", "0",
+		"-pid-file", pidFile,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	addr := fmt.Sprintf("http://127.0.0.1:%d/", port)
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+
+	for i := 0; ; i++ {
+		resp, err := client.Get(addr)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if i > 100 {
+			t.Fatal("lb did not start")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	lock := sync.Mutex{}
+	requests := 0
+	failures := []string{}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				resp, err := client.Get(addr)
+				msg := ""
+				if err != nil {
+					msg = err.Error()
+				} else {
+					body, _ := ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode != 200 || string(body) != "HI!" {
+						msg = fmt.Sprintf("%d %s", resp.StatusCode, body)
+					}
+				}
+
+				lock.Lock()
+				requests++
+				if msg != "" {
+					failures = append(failures, msg)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	oldPid := cmd.Process.Pid
+	if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("old process failed %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("old process did not exit")
+	}
+
+	newPid := readPid(t, pidFile)
+	if newPid == oldPid {
+		t.Fatal("pid file was not updated")
+	}
+	defer syscall.Kill(newPid, syscall.SIGKILL)
+
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		t.Fatalf("%d of %d requests failed: %v", len(failures), requests, failures[0])
+	}
+	t.Logf("%d requests, pid %d -> %d", requests, oldPid, newPid)
+
+	if err := syscall.Kill(newPid, syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+}